@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	blockServfail = iota
+	blockNxdomain
+	blockNodata
+	blockRefused
+	blockNull
+	blockSinkhole
+)
+
+const defaultBlockTTL = 300
+
+// blockPolicy makes the answer of the disabled names by prefilters.
+type blockPolicy struct {
+	action int
+	ttl    uint32
+	soa    bool
+	ip4    net.IP // sinkhole
+	ip6    net.IP
+}
+
+func parseBlockPolicy(f *prefilter_descr) (*blockPolicy, error) {
+	var p = &blockPolicy{ttl: defaultBlockTTL, soa: f.Soa}
+	if f.Ttl != nil {
+		if *f.Ttl < 0 {
+			return nil, fmt.Errorf("bad prefilter ttl %d", *f.Ttl)
+		}
+		p.ttl = uint32(*f.Ttl)
+	}
+	switch strings.ToLower(f.Action) {
+	case "", "servfail":
+		p.action = blockServfail
+	case "nxdomain":
+		p.action = blockNxdomain
+	case "nodata":
+		p.action = blockNodata
+	case "refused":
+		p.action = blockRefused
+	case "null":
+		p.action = blockNull
+		p.ip4, p.ip6 = net.IPv4zero.To4(), net.IPv6zero
+	case "sinkhole":
+		p.action = blockSinkhole
+		for _, s := range f.Sinkhole {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad sinkhole %s", s)
+			}
+			if ip4 := ip.To4(); ip4 == nil && p.ip6 == nil {
+				p.ip6 = ip
+			} else if ip4 != nil && p.ip4 == nil {
+				p.ip4 = ip4
+			} else {
+				return nil, fmt.Errorf("one sinkhole of each family at most, %s", s)
+			}
+		}
+		if p.ip4 == nil && p.ip6 == nil {
+			return nil, fmt.Errorf("sinkhole requires addresses")
+		}
+	default:
+		return nil, fmt.Errorf("bad prefilter action %q", f.Action)
+	}
+	return p, nil
+}
+
+func (p *blockPolicy) reply(req *dns.Msg) *dns.Msg {
+	var resp = new(dns.Msg)
+	q := req.Question[0]
+	switch p.action {
+	case blockServfail:
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return resp
+	case blockRefused:
+		resp.SetRcode(req, dns.RcodeRefused)
+		return resp
+	case blockNxdomain:
+		resp.SetRcode(req, dns.RcodeNameError)
+	default:
+		resp.SetReply(req)
+	}
+	resp.RecursionAvailable = true
+
+	hdr := dns.RR_Header{Name: q.Name, Class: q.Qclass, Ttl: p.ttl}
+	switch {
+	case p.action < blockNull:
+	case q.Qtype == dns.TypeA && p.ip4 != nil:
+		hdr.Rrtype = dns.TypeA
+		resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: p.ip4}}
+	case q.Qtype == dns.TypeAAAA && p.ip6 != nil:
+		hdr.Rrtype = dns.TypeAAAA
+		resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: p.ip6}}
+	}
+	// negative caching by the SOA minimum (RFC 2308)
+	if len(resp.Answer) == 0 && p.soa {
+		hdr.Rrtype = dns.TypeSOA
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr:     hdr,
+			Ns:      "blocked.invalid.",
+			Mbox:    "hostmaster.blocked.invalid.",
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  p.ttl,
+		}}
+	}
+	return resp
+}
@@ -18,13 +18,32 @@ func newRRCache() *rrcache {
 	}
 }
 
+// DNSSEC-aware clients are answered with the different records
 func msgKey(m *dns.Msg) string {
 	q := m.Question[0]
-	return fmt.Sprintf("%s%d%d", q.Name, q.Qclass, q.Qtype)
+	var flags byte
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		flags |= 1
+	}
+	if m.CheckingDisabled {
+		flags |= 2
+	}
+	return fmt.Sprintf("%s%d%d/%d", q.Name, q.Qclass, q.Qtype, flags)
 }
 
-func (c *rrcache) get(req *dns.Msg) *dns.Msg {
-	v, found := c.cache.GetNotStale(msgKey(req))
+// The answer varies with the client subnet, and the records were cached
+// by the subnet at the scope prefix. The unscoped answer is kept apart at
+// "key@", for the clients without subnet.
+type ecsScope uint8
+
+func (c *rrcache) get(key string, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	v, found := c.cache.GetNotStale(key)
+	if scope, y := v.(ecsScope); y && found && subnet != nil {
+		key += "@" + subnetKey(subnet, uint8(scope))
+	} else {
+		key += "@"
+	}
+	v, found = c.cache.GetNotStale(key)
 	if found {
 		return v.(*dns.Msg).Copy()
 	} else {
@@ -32,7 +51,15 @@ func (c *rrcache) get(req *dns.Msg) *dns.Msg {
 	}
 }
 
-func (c *rrcache) set(resp *dns.Msg, lshift uint) {
+// the scope prefix of the subnet option in response
+func responseScope(resp *dns.Msg) uint8 {
+	if e := requestSubnet(resp); e != nil {
+		return e.SourceScope
+	}
+	return 0
+}
+
+func (c *rrcache) set(key string, subnet *dns.EDNS0_SUBNET, resp *dns.Msg, lshift uint) {
 	var expiry uint32 = 3600
 	for _, rr := range resp.Answer {
 		ttl := rr.Header().Ttl
@@ -45,5 +72,12 @@ func (c *rrcache) set(resp *dns.Msg, lshift uint) {
 	} else {
 		expiry <<= lshift
 	}
-	c.cache.Set(msgKey(resp), resp, time.Now().Add(time.Duration(expiry)*1e9))
+	expires := time.Now().Add(time.Duration(expiry) * 1e9)
+	if scope := responseScope(resp); subnet != nil && scope > 0 {
+		c.cache.Set(key, ecsScope(scope), expires)
+		key += "@" + subnetKey(subnet, scope)
+	} else {
+		key += "@"
+	}
+	c.cache.Set(key, resp, expires)
 }
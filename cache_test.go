@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The unscoped answer doesn't replace the scoped ones at the same key.
+func TestCacheSubnetScope(t *testing.T) {
+	c := newRRCache()
+	answer := func(ip string, scope uint8) *dns.Msg {
+		var m dns.Msg
+		m.SetQuestion("example.com.", dns.TypeA)
+		rr, _ := dns.NewRR("example.com. 60 IN A " + ip)
+		m.Answer = []dns.RR{rr}
+		if scope > 0 {
+			var opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			opt.Option = []dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: scope, Address: net.ParseIP("192.0.2.0")}}
+			m.Extra = []dns.RR{opt}
+		}
+		return &m
+	}
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.1")}
+	other := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.1")}
+
+	c.set("k", subnet, answer("192.0.2.53", 24), 0)
+	c.set("k", nil, answer("203.0.113.53", 0), 0)
+	var tests = []struct {
+		subnet *dns.EDNS0_SUBNET
+		ip     string // empty if missed
+	}{
+		{subnet, "192.0.2.53"},
+		{nil, "203.0.113.53"},
+		{other, ""},
+	}
+	for i, tt := range tests {
+		m := c.get("k", tt.subnet)
+		var got string
+		if m != nil {
+			got = m.Answer[0].(*dns.A).A.String()
+		}
+		if got != tt.ip {
+			t.Errorf("%d: got %q, want %q", i, got, tt.ip)
+		}
+	}
+}
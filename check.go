@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// configError is a problem of the config item at the position.
+type configError struct {
+	pos token.Pos
+	msg string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: %s", e.pos, e.msg)
+}
+
+// configErrors are all the problems found on loading, in the order of
+// positions.
+type configErrors []*configError
+
+func (es configErrors) Error() string {
+	var lines = make([]string, len(es))
+	for i, e := range es {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configChecker collects the errors of items instead of stopping at the
+// first one. The items are located by their paths in the syntax trees,
+// eg. "backends", "default", 1 for the second address of default group.
+// The lists of the same path in several files are indexed as appended.
+type configChecker struct {
+	file      string
+	positions map[string]token.Pos
+	lengths   map[string]int
+	order     map[string]int // of the files added
+	errs      configErrors
+}
+
+func itemPath(parts []interface{}) string {
+	var arr = make([]string, len(parts))
+	for i, p := range parts {
+		arr[i] = fmt.Sprint(p)
+	}
+	return strings.Join(arr, "\x00")
+}
+
+func keyText(k *ast.ObjectKey) string {
+	if s, y := k.Token.Value().(string); y {
+		return s
+	}
+	return k.Token.Text
+}
+
+func newConfigChecker(file string) *configChecker {
+	return &configChecker{
+		file:      file,
+		positions: make(map[string]token.Pos),
+		lengths:   make(map[string]int),
+		order:     make(map[string]int),
+	}
+}
+
+// Locate the items of the file, should be added in the order of merging.
+func (ck *configChecker) add(file string, root *ast.File) {
+	ck.order[file] = len(ck.order)
+	if list, y := root.Node.(*ast.ObjectList); y {
+		ck.walk(file, nil, list)
+	}
+}
+
+func (ck *configChecker) walk(file string, parent []interface{}, list *ast.ObjectList) {
+	for _, item := range list.Items {
+		var path = append([]interface{}{}, parent...)
+		for _, k := range item.Keys {
+			path = append(path, keyText(k))
+		}
+		ck.record(file, path, item.Pos())
+		ck.walkValue(file, path, item.Val)
+	}
+}
+
+func (ck *configChecker) walkValue(file string, path []interface{}, node ast.Node) {
+	switch n := node.(type) {
+	case *ast.ObjectType:
+		ck.walk(file, path, n.List)
+	case *ast.ListType:
+		key := itemPath(path)
+		base := ck.lengths[key]
+		for i, elem := range n.List {
+			var epath = append(append([]interface{}{}, path...), base+i)
+			ck.record(file, epath, elem.Pos())
+			ck.walkValue(file, epath, elem)
+		}
+		ck.lengths[key] = base + len(n.List)
+	}
+}
+
+// The duplicate keys of the named sections are reported, they would
+// overwrite each other silently.
+func (ck *configChecker) record(file string, path []interface{}, pos token.Pos) {
+	pos.Filename = file
+	key := itemPath(path)
+	if prev, y := ck.positions[key]; y && len(path) == 2 {
+		switch path[0] {
+		case "backends", "filters", "selectors", "domains":
+			ck.errs = append(ck.errs, &configError{pos, fmt.Sprintf("duplicate %s %q, previous at %s:%d",
+				strings.TrimSuffix(path[0].(string), "s"), path[1], prev.Filename, prev.Line)})
+			return
+		}
+	}
+	if _, y := ck.positions[key]; !y {
+		ck.positions[key] = pos
+	}
+}
+
+// The position of the item, or its nearest parent.
+func (ck *configChecker) position(path []interface{}) token.Pos {
+	for i := len(path); i > 0; i-- {
+		if pos, y := ck.positions[itemPath(path[:i])]; y {
+			return pos
+		}
+	}
+	return token.Pos{Filename: ck.file}
+}
+
+func (ck *configChecker) errorf(path []interface{}, format string, args ...interface{}) {
+	ck.errs = append(ck.errs, &configError{ck.position(path), fmt.Sprintf(format, args...)})
+}
+
+// Run the parsing of the item, the panic is recorded as its error. The
+// nil checker lets the panic through.
+func (ck *configChecker) try(fn func(), path ...interface{}) (ok bool) {
+	if ck == nil {
+		fn()
+		return true
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			ck.errorf(path, "%v", e)
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+func (ck *configChecker) err() error {
+	if len(ck.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(ck.errs, func(i, j int) bool {
+		a, b := ck.errs[i].pos, ck.errs[j].pos
+		if a.Filename != b.Filename {
+			return ck.order[a.Filename] < ck.order[b.Filename]
+		}
+		return a.Offset < b.Offset
+	})
+	return ck.errs
+}
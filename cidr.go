@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// cidrTree is a binary trie of address prefixes for the longest match,
+// ipv4 and ipv6 are stored in separate roots.
+type cidrTree struct {
+	root4 *cidrNode
+	root6 *cidrNode
+	size  int
+}
+
+type cidrNode struct {
+	child [2]*cidrNode
+	ipnet *net.IPNet // set if a prefix ends here
+	value interface{}
+}
+
+func newCidrTree() *cidrTree {
+	return &cidrTree{root4: new(cidrNode), root6: new(cidrNode)}
+}
+
+// "IP/N" or a single "IP", the v4-mapped ipv6 stays ipv6.
+func parseCIDR(s string) (*net.IPNet, error) {
+	var v6 = strings.Contains(s, ":")
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		if ip4 := ip.To4(); ip4 != nil && !v6 {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if v6 {
+		ipnet.IP = ipnet.IP.To16()
+	} else if ip4 := ipnet.IP.To4(); ip4 != nil {
+		ipnet.IP = ip4
+	}
+	return ipnet, nil
+}
+
+// The root of the address, the v4-mapped one is taken as ipv4 like the
+// clients of dual-stack sockets.
+func (t *cidrTree) rootOf(ip net.IP) (*cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.root4, ip4
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return t.root6, ip6
+	}
+	return nil, nil
+}
+
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i>>3]>>(7-uint(i&7))) & 1
+}
+
+// The prefix is of the family by the length of parseCIDR.
+func (t *cidrTree) insert(ipnet *net.IPNet, value interface{}) {
+	node, ip := t.root6, ipnet.IP
+	if len(ip) == net.IPv4len {
+		node = t.root4
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != len(ip)*8 {
+		return
+	}
+	for i := 0; i < ones; i++ {
+		b := bitAt(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = new(cidrNode)
+		}
+		node = node.child[b]
+	}
+	if node.ipnet == nil {
+		t.size++
+	}
+	node.ipnet, node.value = ipnet, value
+}
+
+// The longest prefix containing ip.
+func (t *cidrTree) match(ip net.IP) (*net.IPNet, interface{}, bool) {
+	return t.longest(t.rootOf(ip))
+}
+
+// The address of A or AAAA record, only A is matched in the ipv4 trie.
+func (t *cidrTree) matchAnswer(rr dns.RR) (*net.IPNet, interface{}, bool) {
+	switch r := rr.(type) {
+	case *dns.A:
+		if ip4 := r.A.To4(); ip4 != nil {
+			return t.longest(t.root4, ip4)
+		}
+	case *dns.AAAA:
+		if ip6 := r.AAAA.To16(); ip6 != nil {
+			return t.longest(t.root6, ip6)
+		}
+	}
+	return nil, nil, false
+}
+
+func (t *cidrTree) longest(node *cidrNode, ip net.IP) (*net.IPNet, interface{}, bool) {
+	var found *cidrNode
+	for i := 0; node != nil; i++ {
+		if node.ipnet != nil {
+			found = node
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.child[bitAt(ip, i)]
+	}
+	if found == nil {
+		return nil, nil, false
+	}
+	return found.ipnet, found.value, true
+}
+
+func (t *cidrTree) contains(ip net.IP) bool {
+	_, _, y := t.match(ip)
+	return y
+}
+
+func (t *cidrTree) containsAnswer(rr dns.RR) bool {
+	_, _, y := t.matchAnswer(rr)
+	return y
+}
+
+// Load the items of "CIDR" or "@file_name" into the tree.
+func parseCidrList(t *cidrTree, arr []string, value interface{}) {
+	var callback = func(item string) {
+		ipnet, err := parseCIDR(item)
+		if err != nil {
+			panic("bad cidr " + item)
+		}
+		t.insert(ipnet, value)
+	}
+	for _, a := range arr {
+		if strings.HasPrefix(a, "@") {
+			addItemsFromFile(a[1:], callback)
+		} else {
+			callback(a)
+		}
+	}
+}
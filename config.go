@@ -7,9 +7,11 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/armon/go-radix"
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/printer"
 	"github.com/miekg/dns"
@@ -17,16 +19,41 @@ import (
 
 type config struct {
 	global      *entry // default
-	disabled    *entry // empty entry as disabled reference
-	entries     *radix.Tree
+	entries     *domainMatcher
+	prefilters  *prefilterSet
+	listeners   map[string]*listener
 	allFilters  filterSet
 	allBackends backendSet
+	selectors   map[string]*selector
+	maxUDPSize  int
+	edns        *ednsPolicy
+	validator   *validator    // nil if dnssec validation is off
+	verifier    *verifier     // nil if not verifying the dubious answers
+	lists       *listFetcher  // of the remote lists
+	done        chan struct{} // stopping the background tasks
+	descr       *config_descr // as parsed, for comparing on reload
 }
 
 type entry struct {
 	backends []*backend
 	filters  []filter
 	records  map[uint32][]dns.RR
+	ecs      *ecsPolicy
+	selector *selector
+	window   time.Duration // delayed acceptance of udp replies
+	block    *blockPolicy  // answering the disabled names
+	inherits bool          // the backends and selector of global
+	scope    string        // of the cache, the listener overriding the backends
+}
+
+// prefilterSet is the disabled and allowed names with the blocking answer,
+// of the config or a listener.
+type prefilterSet struct {
+	matcher  atomic.Value // *prefilterRules
+	disabled *entry       // empty entry as disabled reference
+	descr    *prefilter_descr
+	refresh  time.Duration // of the remote lists
+	lists    *listFetcher
 }
 
 func (e *entry) resovleReq(req *dns.Msg) *dns.Msg {
@@ -35,7 +62,7 @@ func (e *entry) resovleReq(req *dns.Msg) *dns.Msg {
 	if rr := e.records[key]; rr != nil {
 		var resp = new(dns.Msg)
 		resp.Question = req.Question
-		resp.Answer = rr
+		resp.Answer = ownedRecords(rr, q.Name)
 		resp.Id = req.Id
 		resp.Response = true
 		return resp
@@ -44,59 +71,119 @@ func (e *entry) resovleReq(req *dns.Msg) *dns.Msg {
 	}
 }
 
-func reverseCharacters(src string) string {
-	a := []byte(src)
-	for i, j := 0, len(a)-1; i < j; i, j = i+1, j-1 {
-		a[j], a[i] = a[i], a[j]
+// The records of glob or regexp zones are answered with the query name
+func ownedRecords(rrs []dns.RR, name string) []dns.RR {
+	var arr = make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+		}
+		arr[i] = rr
 	}
-	return string(a)
+	return arr
 }
 
-func (c *config) findEntry(name string) *entry {
-	name = reverseCharacters(name)
-	if name[0] == '.' {
-		name = name[1:]
-	}
-	_, val, found := c.entries.LongestPrefix(name)
+func (c *config) findEntry(name string, p *prefilterSet) *entry {
+	var result = c.global
+	val, depth, found := c.entries.match(name)
 	if found {
-		return val.(*entry)
-	} else {
-		return c.global
+		result = val.(*entry)
+	}
+	// the deeper rule wins, and prefilters win at the same depth
+	pdepth, disabled := p.matcher.Load().(*prefilterRules).match(name)
+	if disabled && pdepth >= depth {
+		result = p.disabled
 	}
+	return result
 }
 
-const (
-	defaultLabel = "default"
-)
+// prefilterRules are the disabled and allowed names matched separately,
+// the allowed is the exception of disabled whatever the kinds of rules,
+// eg. the suffix allowed over the exact names of hosts lists.
+type prefilterRules struct {
+	disabled *domainMatcher
+	allowed  *domainMatcher
+}
 
-// Parse IPv4 address (d.d.d.d).
-func parseIPv4(s string) uint32 {
-	var a uint32
-	var m byte
-	for _, c := range []byte(s) {
-		if c >= '0' && c <= '9' { // number
-			m = m*10 + c - '0'
-		} else if c == '.' {
-			a, m = (a<<8)|uint32(m), 0
-		} else { // exception
-			return 0
-		}
+func newPrefilterRules() *prefilterRules {
+	return &prefilterRules{disabled: newDomainMatcher(), allowed: newDomainMatcher()}
+}
+
+func (r *prefilterRules) compile() {
+	r.disabled.compile()
+	r.allowed.compile()
+}
+
+func (r *prefilterRules) rules() int {
+	return r.disabled.rules + r.allowed.rules
+}
+
+// The rank of the disabled rule, unless allowed at the same or a deeper
+// name.
+func (r *prefilterRules) match(name string) (rank int, disabled bool) {
+	_, rank, disabled = r.disabled.match(name)
+	if !disabled {
+		return
+	}
+	if _, arank, y := r.allowed.match(name); y && arank&0xffff >= rank&0xffff {
+		return 0, false
 	}
-	return (a << 8) | uint32(m)
+	return
 }
 
+const (
+	defaultLabel = "default"
+)
+
 type prefilter_descr struct {
 	Disabled []string
+	Allowed  []string
+	Action   string
+	Sinkhole []string
+	Ttl      *int
+	Soa      bool
+	CacheDir string `hcl:"cache_dir"`
+	Refresh  string
+	MaxSize  int `hcl:"max_size"`
 }
 
 type filter_descr struct {
 	Drop    []string
 	Replace []string
+	Action  string
+}
+
+type edns_descr struct {
+	Default string
+	Pass    []string
+	Strip   []string
+}
+
+type dnssec_descr struct {
+	Validate     bool
+	TrustAnchors []string `hcl:"trust_anchors"`
+}
+
+type selector_descr struct {
+	Domestic []string
+	Foreign  []string
+	Routes   []string
+}
+
+type verify_descr struct {
+	Backends  []string
+	LearnFile string `hcl:"learn_file"`
 }
 
 type domain_descr struct {
-	Backends []string
-	Filters  []string
+	Backends  []string
+	Filters   []string
+	Selector  string
+	Window    string
+	Ecs       string
+	EcsPrefix []int  `hcl:"ecs_prefix"`
+	EcsSubnet string `hcl:"ecs_subnet"`
 }
 
 type config_descr struct {
@@ -104,7 +191,34 @@ type config_descr struct {
 	Backends   map[string][]string
 	Filters    map[string]*filter_descr
 	Domains    map[string]*domain_descr
+	Selectors  map[string]*selector_descr
 	Zones      []string
+	Bootstrap  []string
+	MaxUDPSize int `hcl:"max_udp_size"`
+	Edns       *edns_descr
+	Dnssec     *dnssec_descr
+	Verify     *verify_descr
+	Include    []string
+	Listen     map[string]*listen_descr
+}
+
+// "a=1&b=2" without translating '+' into space, since base64 pins contain it.
+func parseBackendOptions(rawQuery string) map[string][]string {
+	var opts = make(map[string][]string)
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		var k, v = kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		if uv, err := url.PathUnescape(v); err == nil {
+			v = uv
+		}
+		opts[k] = append(opts[k], v)
+	}
+	return opts
 }
 
 func parseBackend(s string) *backend {
@@ -113,115 +227,301 @@ func parseBackend(s string) *backend {
 		panic(err)
 	}
 	be := &backend{
-		net:  u.Scheme,
-		addr: u.Host,
+		net:     u.Scheme,
+		addr:    u.Host,
+		timeout: _TIMEOUT_2,
+	}
+	var defaultPort = ":53"
+	switch be.net {
+	case "tls":
+		defaultPort = ":853"
+	case "https":
+		defaultPort = ":443"
 	}
 	_, _, err = net.SplitHostPort(u.Host)
 	if ae, y := err.(*net.AddrError); y {
 		if strings.Contains(ae.Err, "port") {
-			be.addr += ":53"
+			be.addr += defaultPort
 		} else {
 			panic(err)
 		}
 	}
 	be.url = fmt.Sprintf("%s://%s", be.net, be.addr)
+
+	opts := parseBackendOptions(u.RawQuery)
+	if v := opts["timeout"]; v != nil {
+		be.timeout, err = time.ParseDuration(v[0])
+		if err != nil || be.timeout <= 0 {
+			panic("bad timeout of backend " + s)
+		}
+	}
+
+	if v := opts["window"]; v != nil {
+		be.window, err = time.ParseDuration(v[0])
+		if err != nil || be.window <= 0 || !strings.HasPrefix(be.net, "udp") {
+			panic("bad window of backend " + s)
+		}
+	}
+
+	switch be.net {
+	case "udp", "udp4", "udp6":
+		tcpNet := strings.Replace(be.net, "udp", "tcp", 1)
+		be.tcp = &backend{
+			net:     tcpNet,
+			addr:    be.addr,
+			url:     fmt.Sprintf("%s://%s", tcpNet, be.addr),
+			timeout: _TIMEOUT,
+		}
+	case "tcp", "tcp4", "tcp6":
+	case "tls":
+		// tls://host[:853][?pin=base64_spki_sha256][#servername]
+		servername := u.Fragment
+		if servername == "" {
+			servername = u.Hostname()
+		} else {
+			be.url += "#" + servername
+		}
+		be.tlsConfig, err = newBackendTLSConfig(servername, opts["pin"])
+		if err != nil {
+			panic(err)
+		}
+		if opts["timeout"] == nil {
+			be.timeout = _TIMEOUT
+		}
+	case "https":
+		// https://host[:443]/path[?method=get][&bootstrap=ip]...
+		// the options of our own are removed from the endpoint
+		var rest []string
+		for _, kv := range strings.Split(u.RawQuery, "&") {
+			switch strings.SplitN(kv, "=", 2)[0] {
+			case "", "method", "timeout", "bootstrap":
+			default:
+				rest = append(rest, kv)
+			}
+		}
+		u.RawQuery = strings.Join(rest, "&")
+		u.Fragment = ""
+		be.url = u.String()
+		if opts["timeout"] == nil {
+			be.timeout = _TIMEOUT
+		}
+		var get bool
+		if v := opts["method"]; v != nil {
+			switch strings.ToLower(v[0]) {
+			case "get":
+				get = true
+			case "post":
+			default:
+				panic("bad method of backend " + s)
+			}
+		}
+		be.doh = newDohClient(be.url, u.Hostname(), get, be.timeout)
+		for _, a := range opts["bootstrap"] {
+			be.doh.bootstrap = append(be.doh.bootstrap, bootstrapAddr(a))
+		}
+	default:
+		panic("bad backend " + s)
+	}
 	return be
 }
 
-func parseDenyFilters(arr []string) filter {
-	var f droppingV4Filter
-	f.rules = make(map[uint32]bool)
-	var callback = func(item string) {
-		ip_num := parseIPv4(item)
-		if ip_num == 0 {
-			panic("bad filter " + item)
+// "ip" or "ip:port"
+func bootstrapAddr(a string) string {
+	if net.ParseIP(a) != nil {
+		return net.JoinHostPort(a, "53")
+	}
+	if _, _, err := net.SplitHostPort(a); err != nil {
+		panic("bad bootstrap address " + a)
+	}
+	return a
+}
+
+// The https backends without their own bootstrap servers will use the global
+// bootstrap list, or the plain backends of the default group at last.
+func setupBootstrap(bs backendSet, bootstrap []string) {
+	var servers []string
+	for _, a := range bootstrap {
+		servers = append(servers, bootstrapAddr(a))
+	}
+	if len(servers) == 0 {
+		for _, be := range bs[defaultLabel] {
+			if be.doh == nil && be.tlsConfig == nil {
+				servers = append(servers, be.addr)
+			}
 		}
-		f.rules[ip_num] = true
 	}
-	for _, a := range arr {
-		if strings.HasPrefix(a, "@") {
-			addItemsFromFile(a[1:], callback)
-		} else {
-			callback(a)
+	for _, group := range bs {
+		for _, be := range group {
+			if be.doh != nil && len(be.doh.bootstrap) == 0 {
+				be.doh.bootstrap = servers
+			}
 		}
 	}
+}
+
+func parseDenyFilters(ck *configChecker, label string, arr []string, action string) filter {
+	var f = droppingFilter{rules: newCidrTree()}
+	var err error
+	if f.action, err = parseFilterAction(action); err != nil {
+		ck.errorf([]interface{}{"filters", label, "action"}, "%v", err)
+	}
+	for i, a := range arr {
+		ck.try(func() { parseCidrList(f.rules, []string{a}, true) }, "filters", label, "drop", i)
+	}
 	return &f
 }
 
-func parseReplaceFilter(arr []string) filter {
-	var f replacementV4Filter
-	f.rules = make(map[uint32]uint32)
-	for _, a := range arr {
-		parr := strings.Split(a, "/")
-		if len(parr) != 2 {
-			panic("bad filter " + a)
-		}
-		ip_a := parseIPv4(parr[0])
-		ip_b := parseIPv4(parr[1])
-		if ip_a*ip_b == 0 {
-			panic("bad filter " + a)
+// "FROM -> TO" of CIDR or IP, or the old form "IPv4_A/IPv4_B"
+func parseReplacement(item string) (from, to *net.IPNet, err error) {
+	var parr []string
+	if strings.Contains(item, "->") {
+		parr = strings.Split(item, "->")
+	} else if parr = strings.Split(item, "/"); len(parr) == 2 && !strings.Contains(parr[1], ".") {
+		parr = nil
+	}
+	if len(parr) != 2 {
+		return nil, nil, fmt.Errorf("bad filter %s", item)
+	}
+	if from, err = parseCIDR(strings.TrimSpace(parr[0])); err != nil {
+		return
+	}
+	if to, err = parseCIDR(strings.TrimSpace(parr[1])); err != nil {
+		return
+	}
+	if len(from.IP) != len(to.IP) {
+		err = fmt.Errorf("bad filter %s, not the same family", item)
+	}
+	return
+}
+
+func parseReplaceFilter(ck *configChecker, label string, arr []string) filter {
+	var f = replacementFilter{rules: newCidrTree()}
+	for i, a := range arr {
+		from, to, err := parseReplacement(a)
+		if err != nil {
+			ck.errorf([]interface{}{"filters", label, "replace", i}, "%v", err)
+			continue
 		}
-		f.rules[ip_a] = ip_b
+		f.rules.insert(from, to)
 	}
 	return &f
 }
 
-func parseFilter(fs filterSet, label string, f *filter_descr) {
+func parseFilter(ck *configChecker, fs filterSet, label string, f *filter_descr) {
 	filters := fs[label]
 	if f.Drop != nil {
-		filters = append(filters, parseDenyFilters(f.Drop))
+		filters = append(filters, parseDenyFilters(ck, label, f.Drop, f.Action))
 	}
 	if f.Replace != nil {
-		filters = append(filters, parseReplaceFilter(f.Replace))
+		filters = append(filters, parseReplaceFilter(ck, label, f.Replace))
 	}
 	fs[label] = filters
 }
 
-func (c *config) parseDomain(d *domain_descr) *entry {
+func (c *config) parseDomain(ck *configChecker, key string, d *domain_descr) *entry {
 	var entry = new(entry)
-	for _, str := range d.Backends {
-		bs := c.allBackends[str]
-		if bs == nil {
-			panic("bad backend reference")
+	var path = func(parts ...interface{}) []interface{} {
+		return append([]interface{}{"domains", key}, parts...)
+	}
+	for i, str := range d.Backends {
+		bs, y := c.allBackends[str]
+		if !y {
+			ck.errorf(path("backends", i), "unknown backend %q", str)
 		}
 		entry.backends = append(entry.backends, bs...)
 	}
-	for _, str := range d.Filters {
-		f := c.allFilters[str]
-		if f == nil {
-			panic("bad filter reference")
+	for i, str := range d.Filters {
+		f, y := c.allFilters[str]
+		if !y {
+			ck.errorf(path("filters", i), "unknown filter %q", str)
 		}
 		entry.filters = append(entry.filters, f...)
 	}
+	if d.Selector != "" {
+		entry.selector = c.selectors[d.Selector]
+		if entry.selector == nil {
+			ck.errorf(path("selector"), "unknown selector %q", d.Selector)
+		}
+	}
+	if d.Window != "" {
+		var err error
+		entry.window, err = time.ParseDuration(d.Window)
+		if err != nil || entry.window <= 0 {
+			ck.errorf(path("window"), "bad window %q", d.Window)
+		}
+	}
+	ecs, err := parseEcsPolicy(d)
+	if err != nil {
+		ck.errorf(path("ecs"), "%v", err)
+	}
+	entry.ecs = ecs
 	return entry
 }
 
-func (c *config) parseZones(t *radix.Tree, zones []string) {
-	for _, str := range zones {
-		str = strings.TrimSpace(str)
-		rr, err := dns.NewRR(str)
-		if err != nil {
-			panic(err)
+// The records are of the exact name or the glob owner, or the regexp
+// preceding the record like "/^ad[0-9]+\./ 300 IN A 0.0.0.0". The entry
+// of the exact name inherits the one which the name matches.
+func (c *config) parseZones(ck *configChecker, m *domainMatcher, zones []string) {
+	for i, str := range zones {
+		if !strings.HasPrefix(str, "@") {
+			ck.try(func() { c.addRecord(m, str) }, "zones", i)
+			continue
 		}
-		rrname := rr.Header().Name
-		rrname = reverseCharacters(rrname)[1:]
-		nkey, en, y := t.LongestPrefix(rrname)
-		var de *entry
-		if !y || nkey != rrname {
-			de = new(entry)
-			t.Insert(rrname, de)
-		} else {
-			de = en.(*entry)
+		ck.try(func() {
+			readList(c.lists, str, func(item listItem) {
+				switch {
+				case item.kind == itemRule: // a record per line
+					c.addRecord(m, item.rule)
+				case item.kind == itemAddress && item.addr != "":
+					c.addRecord(m, addressRecord(item))
+				}
+			})
+		}, "zones", i)
+	}
+}
+
+// Add the record of zone, panics if invalid.
+func (c *config) addRecord(m *domainMatcher, str string) {
+	str = strings.TrimSpace(str)
+	var rule string
+	if strings.HasPrefix(str, "/") {
+		rule = strings.Fields(str)[0]
+		str = "regexp.invalid." + str[len(rule):]
+	}
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		panic(err)
+	}
+	if rule == "" {
+		rule = rr.Header().Name
+		if !strings.Contains(rule, "*") {
+			rule = "=" + rule
 		}
-		rrMap := de.records
-		if rrMap == nil {
-			rrMap = make(map[uint32][]dns.RR)
-			de.records = rrMap
+	}
+	var de *entry
+	if en, y := m.get(rule); y {
+		de = en.(*entry)
+	} else {
+		de = new(entry)
+		*de = *c.global
+		if name, kind := parseRule(rule); kind == ruleExact {
+			if en, _, y := m.match(name); y {
+				*de = *en.(*entry)
+			}
+		}
+		de.records = nil
+		if err = m.insert(rule, de); err != nil {
+			panic(err)
 		}
-		h := rr.Header()
-		key := uint32(h.Class)<<16 | uint32(h.Rrtype)
-		rrMap[key] = append(rrMap[key], rr)
 	}
+	rrMap := de.records
+	if rrMap == nil {
+		rrMap = make(map[uint32][]dns.RR)
+		de.records = rrMap
+	}
+	h := rr.Header()
+	key := uint32(h.Class)<<16 | uint32(h.Rrtype)
+	rrMap[key] = append(rrMap[key], rr)
 }
 
 func isAlphabetOrNumber(b byte) bool {
@@ -230,18 +530,29 @@ func isAlphabetOrNumber(b byte) bool {
 		(b >= 'a' && b <= 'z')
 }
 
+// Locate the panic of the list item by the line number.
+func panicAtLine(name string, line *int) {
+	if e := recover(); e != nil {
+		panic(fmt.Sprintf("%s:%d: %v", name, *line, e))
+	}
+}
+
 func addItemsFromFile(name string, callback func(string)) {
 	fr, err := os.Open(name)
 	if err != nil {
 		panic(err)
 	}
 	defer fr.Close()
+	var lineNo int
+	defer panicAtLine(name, &lineNo)
 	rd := bufio.NewReader(fr)
 	for {
+		lineNo++
 		line_b, _, err := rd.ReadLine()
 		if len(line_b) > 0 {
 			line := strings.TrimSpace(string(line_b))
-			if isAlphabetOrNumber(line[0]) {
+			// domain, exact rule, unicode domain, or address
+			if len(line) > 0 && (isAlphabetOrNumber(line[0]) || line[0] == '=' || line[0] >= 0x80) {
 				callback(line)
 			}
 		}
@@ -251,97 +562,251 @@ func addItemsFromFile(name string, callback func(string)) {
 	}
 }
 
-func parsePrefilters(f *prefilter_descr, tree *radix.Tree, e *entry) {
-	var callback = func(item string) {
-		tree.Insert(reverseCharacters(item), e)
-	}
-	for _, name := range f.Disabled {
-		if len(name) > 1 {
-			// include file
-			if name[0] == '@' {
-				addItemsFromFile(name[1:], callback)
-			} else { // normal entry
-				tree.Insert(reverseCharacters(name), e)
+// The errors are collected by the checker at the path, or panic if nil.
+func parsePrefilters(ck *configChecker, lists *listFetcher, path []interface{}, f *prefilter_descr, m *prefilterRules) {
+	var insert = func(field string, names []string, disabled bool) {
+		var insertRule = func(item string, disabled bool) {
+			var dm = m.allowed
+			if disabled {
+				dm = m.disabled
+			}
+			if err := dm.insert(item, true); err != nil {
+				panic(err)
+			}
+		}
+		var callback = func(item string) {
+			insertRule(item, disabled)
+		}
+		for i, name := range names {
+			if len(name) > 1 {
+				// include file
+				if name[0] == '@' {
+					ck.try(func() {
+						readList(lists, name, func(item listItem) {
+							switch {
+							case item.kind == itemRule:
+								callback(item.rule)
+							case item.kind == itemAllowed:
+								insertRule(item.rule, false)
+							case item.kind == itemAddress && isNullAddress(item.addr):
+								callback(item.rule)
+							}
+						})
+					}, append(path, field, i)...)
+				} else { // normal entry
+					ck.try(func() { callback(name) }, append(path, field, i)...)
+				}
 			}
 		}
 	}
+	insert("disabled", f.Disabled, true)
+	insert("allowed", f.Allowed, false)
 }
 
-func initialConfig(file string, conf *config) (err error) {
-	//	defer func() {
-	//		if e := recover(); e != nil {
-	//			err = fmt.Errorf("%T:%v", e, e)
-	//		}
-	//	}()
+// The rules of domain list, the servers of dnsmasq list are used as the
+// backends unless specified.
+func (c *config) parseDomainList(m *domainMatcher, src string, e *entry, d *domain_descr) {
+	var serverEntries = make(map[string]*entry)
+	readList(c.lists, src, func(item listItem) {
+		var en = e
+		switch item.kind {
+		case itemRule:
+		case itemServer:
+			if d.Backends == nil && d.Selector == "" {
+				if en = serverEntries[item.addr]; en == nil {
+					en = new(entry)
+					*en = *e
+					en.backends = []*backend{parseBackend(item.addr)}
+					en.selector = nil
+					en.inherits = false
+					serverEntries[item.addr] = en
+				}
+			}
+		default:
+			return
+		}
+		if err := m.insert(item.rule, en); err != nil {
+			panic(err)
+		}
+	})
+}
 
-	content, err := ioutil.ReadFile(file)
+// The errors of items are aggregated as configErrors.
+func initialConfig(file string, conf *config) (err error) {
+	des, ck, err := parseConfig(file)
 	if err != nil {
 		return
 	}
-
-	var des config_descr
-	err = hcl.Unmarshal(content, &des)
-	if err != nil {
-		return
+	if des.Prefilters == nil {
+		des.Prefilters = new(prefilter_descr)
 	}
+	conf.lists = newListFetcher(des.Prefilters.CacheDir, des.Prefilters.MaxSize)
 
 	// parse backends
 	var allBackends = make(backendSet)
 	for k, v := range des.Backends {
 		var bs []*backend
-		for _, a := range v {
-			bs = append(bs, parseBackend(a))
+		for i, a := range v {
+			ck.try(func() { bs = append(bs, parseBackend(a)) }, "backends", k, i)
 		}
 		allBackends[k] = bs
 	}
+	var bootstrapOK = true
+	for i, a := range des.Bootstrap {
+		bootstrapOK = ck.try(func() { bootstrapAddr(a) }, "bootstrap", i) && bootstrapOK
+	}
+	if bootstrapOK {
+		setupBootstrap(allBackends, des.Bootstrap)
+	}
 
 	// parse filters
 	var allFilters = make(filterSet)
 	for k, v := range des.Filters {
-		parseFilter(allFilters, k, v)
+		parseFilter(ck, allFilters, k, v)
 	}
 
 	// set fields of config instance
+	conf.maxUDPSize = des.MaxUDPSize
+	if conf.maxUDPSize == 0 {
+		conf.maxUDPSize = defaultMaxUDPSize
+	} else if conf.maxUDPSize < dns.MinMsgSize || conf.maxUDPSize > dns.MaxMsgSize {
+		ck.errorf([]interface{}{"max_udp_size"}, "bad max_udp_size %d", des.MaxUDPSize)
+	}
+	if conf.edns, err = newEdnsPolicy(des.Edns); err != nil {
+		ck.errorf([]interface{}{"edns"}, "%v", err)
+	}
+	if des.Dnssec != nil && des.Dnssec.Validate {
+		if conf.validator, err = newValidator(conf, des.Dnssec.TrustAnchors); err != nil {
+			ck.errorf([]interface{}{"dnssec", "trust_anchors"}, "%v", err)
+		}
+	}
 	conf.allFilters = allFilters
 	conf.allBackends = allBackends
+	conf.selectors = make(map[string]*selector)
+	for k, v := range des.Selectors {
+		if s := conf.parseSelector(ck, k, v); s != nil {
+			conf.selectors[k] = s
+		}
+	}
 	conf.global = &entry{
 		backends: allBackends[defaultLabel],
 		filters:  allFilters[defaultLabel],
+		selector: conf.selectors[defaultLabel],
+		inherits: true,
+	}
+	if des.Verify != nil {
+		conf.verifier = conf.parseVerify(ck, des.Verify)
+		conf.global.filters = append(conf.global.filters, conf.verifier.learned)
 	}
 
 	// parse domains
-	var entries = radix.New()
-	for k, v := range des.Domains {
-		entry := conf.parseDomain(v)
-		if strings.Contains(k, ",") {
-			for _, nk := range strings.Split(k, ",") {
-				nk = strings.TrimSpace(nk)
-				nk = reverseCharacters(nk)
-				entries.Insert(nk, entry)
-			}
-		} else {
-			k = reverseCharacters(k)
-			entries.Insert(k, entry)
-		}
+	var entries = newDomainMatcher()
+	// sorted, the first regexp matched wins
+	var keys []string
+	for k := range des.Domains {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := des.Domains[k]
+		entry := conf.parseDomain(ck, k, v)
 		// inherit global
-		if entry.backends == nil {
+		if entry.backends == nil && entry.selector == nil {
 			entry.backends = conf.global.backends
+			entry.selector = conf.global.selector
+			entry.inherits = true
 		}
 		if entry.filters == nil {
 			entry.filters = conf.global.filters
+		} else if conf.verifier != nil {
+			entry.filters = append(entry.filters, conf.verifier.learned)
+		}
+		if strings.HasPrefix(k, "@") {
+			ck.try(func() { conf.parseDomainList(entries, k, entry, v) }, "domains", k)
+			continue
+		}
+		for _, nk := range splitRules(k) {
+			if _, y := entries.get(nk); y {
+				ck.errorf([]interface{}{"domains", k}, "duplicate domain %q", nk)
+			} else if err = entries.insert(nk, entry); err != nil {
+				ck.errorf([]interface{}{"domains", k}, "bad domain %q: %v", nk, err)
+			}
 		}
 	}
 	// parse prefilter
-	disabled := &entry{}
-	conf.disabled = disabled
-	parsePrefilters(des.Prefilters, entries, disabled)
+	conf.prefilters = conf.parsePrefilterSet(ck, []interface{}{"prefilters"}, des.Prefilters)
 	// parse zones
-	conf.parseZones(entries, des.Zones)
+	conf.parseZones(ck, entries, des.Zones)
+	// parse listeners
+	conf.listeners = make(map[string]*listener)
+	for k, v := range des.Listen {
+		conf.listeners[k] = conf.parseListener(ck, k, v)
+	}
+	if err = ck.err(); err != nil {
+		return
+	}
+	entries.compile()
 
 	conf.entries = entries
+	conf.descr = des
+	conf.done = make(chan struct{})
+	for _, p := range conf.prefilterSets() {
+		if len(remotePrefilterLists(p.descr)) > 0 {
+			go p.refreshLists(conf.done)
+		}
+	}
 	return
 }
 
+func (c *config) parsePrefilterSet(ck *configChecker, path []interface{}, f *prefilter_descr) *prefilterSet {
+	var p = &prefilterSet{
+		disabled: new(entry),
+		descr:    f,
+		refresh:  defaultListRefresh,
+		lists:    c.lists,
+	}
+	var err error
+	if p.disabled.block, err = parseBlockPolicy(f); err != nil {
+		ck.errorf(path, "%v", err)
+	}
+	if f.Refresh != "" {
+		p.refresh, err = time.ParseDuration(f.Refresh)
+		if err != nil || p.refresh <= 0 {
+			ck.errorf(append(path, "refresh"), "bad prefilter refresh %q", f.Refresh)
+		}
+	}
+	m := newPrefilterRules()
+	parsePrefilters(ck, p.lists, path, f, m)
+	m.compile()
+	p.matcher.Store(m)
+	return p
+}
+
+// The prefilters of config and the listeners
+func (c *config) prefilterSets() []*prefilterSet {
+	var sets = []*prefilterSet{c.prefilters}
+	for _, l := range c.listeners {
+		if l.prefilters != nil {
+			sets = append(sets, l.prefilters)
+		}
+	}
+	return sets
+}
+
+// Parse a new config, the panics of bad items are returned as error.
+func loadConfig(file string) (conf *config, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			conf, err = nil, fmt.Errorf("%v", e)
+		}
+	}()
+	conf = new(config)
+	if err = initialConfig(file, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
 func formatConfig(file string) error {
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
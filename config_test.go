@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The allowed names are the exceptions of the disabled lists, including
+// the exact names of hosts.
+func TestPrefilterAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnspanic-prefilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	content := "0.0.0.0 ad.doubleclick.net\n0.0.0.0 stats.doubleclick.net\n0.0.0.0 x.allowed.example\n"
+	if err = ioutil.WriteFile(hosts, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var c = &config{lists: newListFetcher(dir, 0), global: new(entry), entries: newDomainMatcher()}
+	c.entries.compile()
+	p := c.parsePrefilterSet(nil, nil, &prefilter_descr{
+		Disabled: []string{"@hosts:" + hosts, "tracker.example", "deep.allowed.example"},
+		Allowed:  []string{"ad.doubleclick.net", "allowed.example", "=ok.tracker.example"},
+	})
+	var tests = []struct {
+		name     string
+		disabled bool
+	}{
+		{"ad.doubleclick.net", false},
+		{"sub.ad.doubleclick.net", false},
+		{"stats.doubleclick.net", true},
+		{"x.allowed.example", true},      // the exact name of hosts is deeper
+		{"a.deep.allowed.example", true}, // the disabled is deeper
+		{"tracker.example", true},
+		{"ok.tracker.example", false},
+		{"a.ok.tracker.example", true},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := c.findEntry(tt.name, p) == p.disabled; got != tt.disabled {
+			t.Errorf("%s: disabled %v, want %v", tt.name, got, tt.disabled)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohClient sends the wire format queries to a RFC 8484 endpoint.
+type dohClient struct {
+	endpoint  string
+	get       bool
+	host      string
+	bootstrap []string // plain dns servers to resolve the host
+	client    *http.Client
+
+	mu      sync.Mutex
+	addrs   []string
+	expires time.Time
+}
+
+func newDohClient(u string, host string, get bool, timeout time.Duration) *dohClient {
+	dc := &dohClient{
+		endpoint: u,
+		get:      get,
+		host:     host,
+	}
+	transport := &http.Transport{
+		DialContext:         dc.dialContext,
+		ForceAttemptHTTP2:   true,
+		TLSClientConfig:     &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(8)},
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     time.Minute * 2,
+	}
+	dc.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	return dc
+}
+
+// Resolve the host of endpoint with the bootstrap servers directly,
+// the system resolver may point to ourselves.
+func (dc *dohClient) resolve(ctx context.Context) ([]string, error) {
+	if ip := net.ParseIP(dc.host); ip != nil {
+		return []string{dc.host}, nil
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.addrs != nil && time.Now().Before(dc.expires) {
+		return dc.addrs, nil
+	}
+	if len(dc.bootstrap) == 0 {
+		return nil, errors.New("no bootstrap server to resolve " + dc.host)
+	}
+
+	var lastErr error
+	var clt = dns.Client{Timeout: _TIMEOUT}
+	for _, server := range dc.bootstrap {
+		var addrs []string
+		var ttl uint32 = 3600
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			var req dns.Msg
+			req.SetQuestion(dns.Fqdn(dc.host), qtype)
+			resp, _, err := clt.ExchangeContext(ctx, &req, server)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch r := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, r.A.String())
+				case *dns.AAAA:
+					addrs = append(addrs, r.AAAA.String())
+				default:
+					continue
+				}
+				if rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+			if len(addrs) > 0 {
+				break
+			}
+		}
+		if len(addrs) > 0 {
+			if ttl < 60 {
+				ttl = 60
+			}
+			dc.addrs = addrs
+			dc.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+			return addrs, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no address of " + dc.host)
+	}
+	return nil, lastErr
+}
+
+func (dc *dohClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := dc.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	var conn net.Conn
+	for _, i := range rand.Perm(len(addrs)) {
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(addrs[i], port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (dc *dohClient) exchange(req *dns.Msg) (*dns.Msg, error) {
+	// id should be zero for the http cache friendly
+	var wire = *req
+	wire.Id = 0
+	buf, err := wire.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var hreq *http.Request
+	if dc.get {
+		sep := "?"
+		if strings.Contains(dc.endpoint, "?") {
+			sep = "&"
+		}
+		u := dc.endpoint + sep + "dns=" + base64.RawURLEncoding.EncodeToString(buf)
+		hreq, err = http.NewRequest("GET", u, nil)
+	} else {
+		hreq, err = http.NewRequest("POST", dc.endpoint, bytes.NewReader(buf))
+		if hreq != nil {
+			hreq.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Accept", dohMediaType)
+
+	hresp, err := dc.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, hresp.Body)
+		return nil, fmt.Errorf("http status %s", hresp.Status)
+	}
+	if ct := hresp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMediaType) {
+		return nil, fmt.Errorf("unexpected content-type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	var msg = new(dns.Msg)
+	if err = msg.Unpack(body); err != nil {
+		return nil, err
+	}
+	msg.Id = req.Id
+	return msg, nil
+}
+
+func (q *qClient) queryOverHttps(be *backend, tx *transaction) {
+	start := time.Now()
+	msg, err := be.doh.exchange(tx.req)
+	rtt := int(time.Since(start) / time.Millisecond)
+	tx.reply(msg, rtt, err, be)
+}
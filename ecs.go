@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsStrip = iota + 1
+	ecsPass
+	ecsSynthesize
+)
+
+const (
+	defaultEcsPrefix4 = 24
+	defaultEcsPrefix6 = 56
+)
+
+// ecsPolicy handles the EDNS Client Subnet (RFC 7871) of a domain entry.
+// The strip mode never sends subnet to upstream, pass forwards the subnet of
+// client but not longer than the prefix, and synthesize makes one from the
+// client address if the client sent none.
+type ecsPolicy struct {
+	mode    int
+	prefix4 uint8
+	prefix6 uint8
+	subnet  *net.IPNet // for the clients of private address
+}
+
+func parseEcsPolicy(d *domain_descr) (*ecsPolicy, error) {
+	var p = &ecsPolicy{
+		prefix4: defaultEcsPrefix4,
+		prefix6: defaultEcsPrefix6,
+	}
+	switch strings.ToLower(d.Ecs) {
+	case "":
+		return nil, nil
+	case "strip":
+		p.mode = ecsStrip
+	case "pass":
+		p.mode = ecsPass
+	case "synthesize":
+		p.mode = ecsSynthesize
+	default:
+		return nil, fmt.Errorf("bad ecs mode %q", d.Ecs)
+	}
+	switch len(d.EcsPrefix) {
+	case 0:
+	case 2:
+		if d.EcsPrefix[0] < 0 || d.EcsPrefix[0] > 32 || d.EcsPrefix[1] < 0 || d.EcsPrefix[1] > 128 {
+			return nil, fmt.Errorf("bad ecs_prefix %v", d.EcsPrefix)
+		}
+		p.prefix4, p.prefix6 = uint8(d.EcsPrefix[0]), uint8(d.EcsPrefix[1])
+	default:
+		return nil, fmt.Errorf("ecs_prefix requires [ipv4, ipv6] but got %v", d.EcsPrefix)
+	}
+	if d.EcsSubnet != "" {
+		_, ipnet, err := net.ParseCIDR(d.EcsSubnet)
+		if err != nil {
+			return nil, err
+		}
+		p.subnet = ipnet
+	}
+	return p, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+func newSubnet(ip net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4
+		if prefix > 32 {
+			prefix = 32
+		}
+	} else {
+		e.Family = 2
+		e.Address = ip.To16()
+		if prefix > 128 {
+			prefix = 128
+		}
+	}
+	e.SourceNetmask = prefix
+	e.Address = e.Address.Mask(net.CIDRMask(int(prefix), len(e.Address)*8))
+	return e
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (p *ecsPolicy) maxPrefix(family uint16) uint8 {
+	if family == 1 {
+		return p.prefix4
+	}
+	return p.prefix6
+}
+
+// Set the subnet option of the request to upstream according to the policy,
+// returns the subnet sent finally.
+func (p *ecsPolicy) apply(opt *dns.OPT, req *dns.Msg, client net.Addr) *dns.EDNS0_SUBNET {
+	var options []dns.EDNS0
+	var subnet *dns.EDNS0_SUBNET
+	for _, o := range opt.Option {
+		if e, y := o.(*dns.EDNS0_SUBNET); y {
+			subnet = e
+		} else {
+			options = append(options, o)
+		}
+	}
+	if p == nil { // using the edns policy
+		return subnet
+	}
+
+	var csubnet *dns.EDNS0_SUBNET
+	if copt := req.IsEdns0(); copt != nil {
+		for _, o := range copt.Option {
+			if e, y := o.(*dns.EDNS0_SUBNET); y {
+				csubnet = e
+			}
+		}
+	}
+	subnet = nil
+	switch {
+	case p.mode == ecsStrip:
+	case csubnet != nil:
+		prefix := csubnet.SourceNetmask
+		if max := p.maxPrefix(csubnet.Family); prefix > max {
+			prefix = max
+		}
+		// source 0 means the client doesn't want to be located
+		if csubnet.Family != 0 {
+			subnet = newSubnet(csubnet.Address, prefix)
+		} else {
+			subnet = csubnet
+		}
+	case p.mode == ecsSynthesize:
+		ip := clientIP(client)
+		if ip == nil || isPrivateIP(ip) {
+			if p.subnet == nil {
+				break
+			}
+			ones, _ := p.subnet.Mask.Size()
+			subnet = newSubnet(p.subnet.IP, uint8(ones))
+		} else if ip4 := ip.To4(); ip4 != nil {
+			subnet = newSubnet(ip4, p.prefix4)
+		} else {
+			subnet = newSubnet(ip, p.prefix6)
+		}
+	}
+	if subnet != nil {
+		options = append(options, subnet)
+	}
+	opt.Option = options
+	return subnet
+}
+
+func requestSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, y := o.(*dns.EDNS0_SUBNET); y {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// The key of subnet at the prefix
+func subnetKey(e *dns.EDNS0_SUBNET, prefix uint8) string {
+	if e == nil {
+		return ""
+	}
+	if prefix > e.SourceNetmask {
+		prefix = e.SourceNetmask
+	}
+	var ip = e.Address
+	if e.Family == 1 {
+		ip = ip.To4()
+	}
+	if ip == nil {
+		return ""
+	}
+	ip = ip.Mask(net.CIDRMask(int(prefix), len(ip)*8))
+	return fmt.Sprintf("%s/%d", ip, prefix)
+}
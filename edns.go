@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const defaultMaxUDPSize = 1232
+
+var ednsOptionCodes = map[string]uint16{
+	"llq":       dns.EDNS0LLQ,
+	"ul":        dns.EDNS0UL,
+	"nsid":      dns.EDNS0NSID,
+	"dau":       dns.EDNS0DAU,
+	"dhu":       dns.EDNS0DHU,
+	"n3u":       dns.EDNS0N3U,
+	"subnet":    dns.EDNS0SUBNET,
+	"expire":    dns.EDNS0EXPIRE,
+	"cookie":    dns.EDNS0COOKIE,
+	"keepalive": dns.EDNS0TCPKEEPALIVE,
+	"padding":   dns.EDNS0PADDING,
+}
+
+// ednsPolicy decides which options are forwarded between client and upstream.
+type ednsPolicy struct {
+	passDefault bool
+	rules       map[uint16]bool // option code -> pass
+}
+
+func parseEdnsOption(name string) (uint16, error) {
+	if code, y := ednsOptionCodes[strings.ToLower(name)]; y {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(name, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad edns option %q", name)
+	}
+	return uint16(code), nil
+}
+
+func newEdnsPolicy(d *edns_descr) (*ednsPolicy, error) {
+	var p = &ednsPolicy{rules: make(map[uint16]bool)}
+	if d == nil {
+		return p, nil
+	}
+	switch strings.ToLower(d.Default) {
+	case "", "strip":
+	case "pass":
+		p.passDefault = true
+	default:
+		return nil, fmt.Errorf("bad edns default %q", d.Default)
+	}
+	for _, name := range d.Pass {
+		code, err := parseEdnsOption(name)
+		if err != nil {
+			return nil, err
+		}
+		p.rules[code] = true
+	}
+	for _, name := range d.Strip {
+		code, err := parseEdnsOption(name)
+		if err != nil {
+			return nil, err
+		}
+		p.rules[code] = false
+	}
+	return p, nil
+}
+
+func (p *ednsPolicy) pass(code uint16) bool {
+	switch code {
+	case dns.EDNS0TCPKEEPALIVE, dns.EDNS0PADDING:
+		return false // hop-by-hop
+	}
+	if pass, y := p.rules[code]; y {
+		return pass
+	}
+	return p.passDefault
+}
+
+func (p *ednsPolicy) filterOptions(options []dns.EDNS0) []dns.EDNS0 {
+	var arr []dns.EDNS0
+	for _, o := range options {
+		if p.pass(o.Option()) {
+			arr = append(arr, o)
+		}
+	}
+	return arr
+}
+
+// The OPT of the request to upstream. Keeps the DO bit, buffer size and
+// the options allowed of the client.
+func (p *ednsPolicy) forwardOpt(req *dns.Msg) *dns.OPT {
+	copt := req.IsEdns0()
+	var opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	if copt == nil {
+		opt.Hdr.Class = opt_hdr[0].Header().Class
+		return opt
+	}
+	var size = copt.UDPSize()
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	} else if size > dns.DefaultMsgSize {
+		size = dns.DefaultMsgSize
+	}
+	opt.SetUDPSize(size)
+	if copt.Do() {
+		opt.SetDo()
+	}
+	opt.Option = p.filterOptions(copt.Option)
+	return opt
+}
+
+// Rewrite the OPT of response for the client. Without the OPT if the
+// client did not send one, and without the DNSSEC records if the DO bit
+// is not set.
+func (p *ednsPolicy) replyOpt(req, resp *dns.Msg, maxUDPSize int) {
+	var uopt *dns.OPT
+	var extra []dns.RR
+	for _, rr := range resp.Extra {
+		if o, y := rr.(*dns.OPT); y {
+			uopt = o
+		} else {
+			extra = append(extra, rr)
+		}
+	}
+	copt := req.IsEdns0()
+	if copt != nil {
+		var opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		if uopt != nil {
+			// extended rcode and version
+			opt.Hdr.Ttl = uopt.Hdr.Ttl &^ (1 << 15)
+			opt.Option = p.filterOptions(uopt.Option)
+			opt.Option = replySubnet(opt.Option, requestSubnet(req), requestSubnet(resp))
+		}
+		opt.SetUDPSize(uint16(maxUDPSize))
+		if copt.Do() {
+			opt.SetDo()
+		}
+		extra = append(extra, opt)
+	}
+	resp.Extra = extra
+
+	// RFC 6840 5.8, AD only for those who can understand it
+	if !req.AuthenticatedData && (copt == nil || !copt.Do()) {
+		resp.AuthenticatedData = false
+	}
+	if copt == nil || !copt.Do() {
+		qtype := req.Question[0].Qtype
+		resp.Answer = stripDnssec(resp.Answer, qtype)
+		resp.Ns = stripDnssec(resp.Ns, qtype)
+		resp.Extra = stripDnssec(resp.Extra, qtype)
+	}
+}
+
+// The subnet option is returned only if the client sent one, and it must
+// be the same as sent with the scope of upstream.
+func replySubnet(options []dns.EDNS0, csubnet, usubnet *dns.EDNS0_SUBNET) []dns.EDNS0 {
+	var arr []dns.EDNS0
+	for _, o := range options {
+		if o.Option() != dns.EDNS0SUBNET {
+			arr = append(arr, o)
+		}
+	}
+	if csubnet != nil && usubnet != nil {
+		var e = *csubnet
+		e.SourceScope = usubnet.SourceScope
+		if e.SourceScope > e.SourceNetmask {
+			e.SourceScope = e.SourceNetmask
+		}
+		arr = append(arr, &e)
+	}
+	return arr
+}
+
+func isDnssecType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// the records of the type explicitly queried are kept
+func stripDnssec(rrset []dns.RR, qtype uint16) []dns.RR {
+	var arr []dns.RR
+	for i, rr := range rrset {
+		t := rr.Header().Rrtype
+		if isDnssecType(t) && t != qtype {
+			if arr == nil {
+				arr = append(make([]dns.RR, 0, len(rrset)), rrset[:i]...)
+			}
+			continue
+		}
+		if arr != nil {
+			arr = append(arr, rr)
+		}
+	}
+	if arr == nil {
+		return rrset
+	}
+	return arr
+}
+
+// The largest udp response acceptable by the client, up to max.
+func clientUDPSize(req *dns.Msg, max int) int {
+	var size = dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		if s := int(opt.UDPSize()); s > size {
+			size = s
+		}
+		if size > max {
+			size = max
+		}
+	}
+	return size
+}
+
+// Fit the message in size, the additional records except OPT are dropped
+// first, then answer and authority with the TC bit set, and the client
+// should retry over tcp.
+func truncateMsg(m *dns.Msg, size int) *dns.Msg {
+	m.Compress = true
+	if m.Len() <= size {
+		return m
+	}
+	m = m.Copy()
+	m.Compress = true
+	var extra []dns.RR
+	if opt := m.IsEdns0(); opt != nil {
+		extra = append(extra, opt)
+	}
+	m.Extra = extra
+	if m.Len() > size {
+		m.Truncated = true
+		m.Answer = nil
+		m.Ns = nil
+	}
+	return m
+}
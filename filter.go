@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/binary"
+	"fmt"
 	"log"
+	"net"
 
 	"github.com/miekg/dns"
 )
@@ -10,29 +11,72 @@ import (
 type filterSet map[string][]filter
 
 type filter interface {
-	filter(answers []dns.RR, msg *dns.Msg) []dns.RR
+	filter(answers []dns.RR, ctx *filterContext) []dns.RR
 }
 
-type droppingV4Filter struct {
-	rules map[uint32]bool
+type filterContext struct {
+	msg      *dns.Msg
+	security secState // of the answers validated
+	wait     bool     // waiting for another answer if rejected, or trying the next backend
 }
 
-func (f *droppingV4Filter) filter(answers []dns.RR, msg *dns.Msg) []dns.RR {
+// the address of A in 4 bytes, or of AAAA in 16 bytes
+func answerIP(rr dns.RR) net.IP {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A.To4()
+	case *dns.AAAA:
+		return r.AAAA.To16()
+	}
+	return nil
+}
+
+const (
+	actionDropRetry   = iota // rejecting the response, trying the next backend at once
+	actionDropMessage        // rejecting the response, waiting for another
+	actionDropRecord         // only removing the matched records
+)
+
+func parseFilterAction(s string) (int, error) {
+	switch s {
+	case "", "drop-and-retry-next-backend":
+		return actionDropRetry, nil
+	case "drop-message":
+		return actionDropMessage, nil
+	case "drop-record":
+		return actionDropRecord, nil
+	}
+	return 0, fmt.Errorf("bad filter action %q", s)
+}
+
+type droppingFilter struct {
+	rules  *cidrTree
+	action int
+}
+
+func (f *droppingFilter) filter(answers []dns.RR, ctx *filterContext) []dns.RR {
+	// the signed answers can't be forged
+	if ctx.security == secSecure {
+		return answers
+	}
+	if f.action == actionDropRecord {
+		answers = f.filter1(answers)
+	}
 	var a *dns.A
 	for _, rr := range answers {
-		// only accept A
-		if arr, y := rr.(*dns.A); y {
-			ip := binary.BigEndian.Uint32(arr.A.To4())
-			if f.rules[ip] {
-				log.Println("\tdrop", arr)
+		if ip := answerIP(rr); ip != nil {
+			if f.rules.containsAnswer(rr) {
+				log.Println("\tdrop", rr)
+				ctx.wait = f.action == actionDropMessage
 				return nil
-			} else {
+			}
+			if arr, y := rr.(*dns.A); y {
 				a = arr
 			}
 		}
 	}
 	// passed the test that based on fixed rules
-	if len(answers) == 1 && a != nil && len(msg.Extra) == 0 {
+	if len(answers) == 1 && a != nil && len(ctx.msg.Extra) == 0 {
 		// only got one answer that one is little dubious
 		log.Println("\tshould verify", a.Hdr.Name, a.A)
 		a.Hdr.Ttl = 2
@@ -40,41 +84,53 @@ func (f *droppingV4Filter) filter(answers []dns.RR, msg *dns.Msg) []dns.RR {
 	return answers
 }
 
-// only drop one RR
-func (f *droppingV4Filter) filter1(answers []dns.RR) []dns.RR {
-	max := len(answers) - 1
-	for i := 0; i <= max; {
-		rr := answers[i]
-		// only accept A
-		if arr, y := rr.(*dns.A); y {
-			ip := binary.BigEndian.Uint32(arr.A.To4())
-			if f.rules[ip] {
-				log.Println("\tdrop", arr)
-				// swap i with tail
-				if i < max {
-					answers[i] = answers[max]
-				}
-				max--
-				continue
-			}
+// only drop the matched RRs, the others are kept in order
+func (f *droppingFilter) filter1(answers []dns.RR) []dns.RR {
+	var kept = answers[:0]
+	for _, rr := range answers {
+		if f.rules.containsAnswer(rr) {
+			log.Println("\tdrop", rr)
+			continue
 		}
-		i++
+		kept = append(kept, rr)
 	}
-	return answers[:max+1]
+	return kept
 }
 
-type replacementV4Filter struct {
-	rules map[uint32]uint32
+// replacementFilter maps the address in a prefix into another prefix,
+// the host bits out of the target prefix are kept.
+type replacementFilter struct {
+	rules *cidrTree // value is the target *net.IPNet
 }
 
-func (f *replacementV4Filter) filter(answers []dns.RR, msg *dns.Msg) []dns.RR {
+// Returns nil if ip is not of the family of to.
+func replaceIP(ip net.IP, to *net.IPNet) net.IP {
+	if len(ip) != len(to.IP) {
+		return nil
+	}
+	var out = make(net.IP, len(ip))
+	for i := range ip {
+		out[i] = to.IP[i]&to.Mask[i] | ip[i]&^to.Mask[i]
+	}
+	return out
+}
+
+func (f *replacementFilter) filter(answers []dns.RR, ctx *filterContext) []dns.RR {
 	for _, rr := range answers {
-		if arr, y := rr.(*dns.A); y {
-			ip := binary.BigEndian.Uint32(arr.A.To4())
-			if repl, y := f.rules[ip]; y {
-				log.Println("\treplace", arr)
-				binary.BigEndian.PutUint32(arr.A, repl)
-			}
+		_, to, y := f.rules.matchAnswer(rr)
+		if !y {
+			continue
+		}
+		out := replaceIP(answerIP(rr), to.(*net.IPNet))
+		if out == nil {
+			continue
+		}
+		log.Println("\treplace", rr)
+		switch r := rr.(type) {
+		case *dns.A:
+			r.A = out
+		case *dns.AAAA:
+			r.AAAA = out
 		}
 	}
 	return answers
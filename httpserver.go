@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// httpServer serves DNS-over-HTTPS (RFC 8484) at /dns-query and the
+// JSON API at /resolve, plain http if without tls config.
+type httpServer struct {
+	http.Server
+	handler dns.Handler
+}
+
+func newHttpServer(addr string, handler dns.Handler, tlsConfig *tls.Config) *httpServer {
+	s := &httpServer{handler: handler}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", s.serveWire)
+	mux.HandleFunc("/resolve", s.serveJSON)
+	s.Addr = addr
+	s.Handler = mux
+	s.TLSConfig = tlsConfig
+	return s
+}
+
+func (s *httpServer) ListenAndServe() error {
+	if s.TLSConfig != nil {
+		return s.Server.ListenAndServeTLS("", "")
+	}
+	return s.Server.ListenAndServe()
+}
+
+func (s *httpServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), _TIMEOUT*2)
+	defer cancel()
+	return s.Server.Shutdown(ctx)
+}
+
+// httpWriter captures the answer written by the dns handler.
+type httpWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newHttpWriter(r *http.Request) *httpWriter {
+	w := new(httpWriter)
+	if addr, y := r.Context().Value(http.LocalAddrContextKey).(net.Addr); y {
+		w.local = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		w.remote = addr
+	}
+	return w
+}
+
+func (w *httpWriter) LocalAddr() net.Addr  { return w.local }
+func (w *httpWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *httpWriter) TsigStatus() error    { return nil }
+func (w *httpWriter) TsigTimersOnly(bool)  {}
+func (w *httpWriter) Hijack()              {}
+func (w *httpWriter) Close() error         { return nil }
+
+func (w *httpWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *httpWriter) Write(buf []byte) (int, error) {
+	var m = new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(buf), nil
+}
+
+func (s *httpServer) resolve(r *http.Request, req *dns.Msg) *dns.Msg {
+	var w = newHttpWriter(r)
+	s.handler.ServeDNS(w, req)
+	return w.msg
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	for i, rr := range m.Answer {
+		if t := rr.Header().Ttl; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+func (s *httpServer) serveWire(rw http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+			http.Error(rw, "unsupported content-type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req = new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil || len(req.Question) == 0 {
+		http.Error(rw, "bad dns message", http.StatusBadRequest)
+		return
+	}
+
+	var resp = s.resolve(r, req)
+	if resp == nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", dohMediaType)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(resp)))
+	rw.Write(out)
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// Google-style json response
+type jsonMsg struct {
+	Status    int
+	TC        bool
+	RD        bool
+	RA        bool
+	AD        bool
+	CD        bool
+	Question  []jsonQuestion
+	Answer    []jsonRR `json:",omitempty"`
+	Authority []jsonRR `json:",omitempty"`
+}
+
+func toJsonRRs(rrs []dns.RR) []jsonRR {
+	var arr []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		arr = append(arr, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return arr
+}
+
+func isTrue(v string) bool {
+	b, _ := strconv.ParseBool(v)
+	return b
+}
+
+// GET /resolve?name=example.com&type=AAAA[&do=1][&cd=1]
+func (s *httpServer) serveJSON(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		http.Error(rw, "bad name", http.StatusBadRequest)
+		return
+	}
+	var qtype = dns.TypeA
+	if t := query.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, y := dns.StringToType[strings.ToUpper(t)]; y {
+			qtype = n
+		} else {
+			http.Error(rw, "bad type", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = isTrue(query.Get("cd"))
+	if isTrue(query.Get("do")) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	var resp = s.resolve(r, req)
+	var jm = jsonMsg{
+		Status:   dns.RcodeServerFailure,
+		RD:       true,
+		RA:       true,
+		Question: []jsonQuestion{{Name: req.Question[0].Name, Type: qtype}},
+	}
+	if resp != nil {
+		jm.Status = resp.Rcode
+		jm.TC = resp.Truncated
+		jm.AD = resp.AuthenticatedData
+		jm.CD = resp.CheckingDisabled
+		jm.Answer = toJsonRRs(resp.Answer)
+		jm.Authority = toJsonRRs(resp.Ns)
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(resp)))
+	}
+	rw.Header().Set("Content-Type", "application/dns-json")
+	json.NewEncoder(rw).Encode(&jm)
+}
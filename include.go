@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// The sections could be split into the included files. The named items
+// of maps are merged, and the same name in several files is a conflict,
+// the zones are appended in the order of files.
+var includeSections = map[string]bool{
+	"backends":  true,
+	"filters":   true,
+	"selectors": true,
+	"domains":   true,
+	"zones":     true,
+}
+
+// Parse the file into the syntax tree and the description.
+func parseConfigFile(file string) (*ast.File, *config_descr, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := hcl.ParseBytes(content)
+	if err != nil {
+		if pe, y := err.(*parser.PosError); y {
+			pe.Pos.Filename = file
+			return nil, nil, &configError{pe.Pos, pe.Err.Error()}
+		}
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	var des = new(config_descr)
+	if err = hcl.DecodeObject(des, root); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return root, des, nil
+}
+
+// Parse the config file then the included files in order, the files
+// matched by a pattern are sorted by name. The relative patterns are of
+// the directory of config file.
+func parseConfig(file string) (*config_descr, *configChecker, error) {
+	root, des, err := parseConfigFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	ck := newConfigChecker(file)
+	ck.add(file, root)
+
+	var seen = map[string]bool{filepath.Clean(file): true}
+	for i, pattern := range des.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			ck.errorf([]interface{}{"include", i}, "bad include %q: %v", des.Include[i], err)
+			continue
+		}
+		if matches == nil && !strings.ContainsAny(pattern, "*?[") {
+			ck.errorf([]interface{}{"include", i}, "no such file %q", des.Include[i])
+		}
+		for _, name := range matches {
+			if seen[filepath.Clean(name)] {
+				continue
+			}
+			seen[filepath.Clean(name)] = true
+			ck.include(des, name)
+		}
+	}
+	return des, ck, nil
+}
+
+// Merge the included file into the description of config.
+func (ck *configChecker) include(des *config_descr, file string) {
+	root, part, err := parseConfigFile(file)
+	if err != nil {
+		if ce, y := err.(*configError); y {
+			ck.errs = append(ck.errs, ce)
+		} else {
+			ck.errs = append(ck.errs, &configError{token.Pos{Filename: file}, err.Error()})
+		}
+		return
+	}
+	// the conflicts are reported while locating
+	ck.add(file, root)
+	ck.resolveLists(part, filepath.Dir(file))
+	for _, item := range root.Node.(*ast.ObjectList).Items {
+		if key := keyText(item.Keys[0]); !includeSections[key] {
+			var pos = item.Pos()
+			pos.Filename = file
+			ck.errs = append(ck.errs, &configError{pos, fmt.Sprintf("%q is not allowed in the included file", key)})
+		}
+	}
+	if des.Backends == nil {
+		des.Backends = make(map[string][]string)
+	}
+	for k, v := range part.Backends {
+		if _, y := des.Backends[k]; !y {
+			des.Backends[k] = v
+		}
+	}
+	if des.Filters == nil {
+		des.Filters = make(map[string]*filter_descr)
+	}
+	for k, v := range part.Filters {
+		if _, y := des.Filters[k]; !y {
+			des.Filters[k] = v
+		}
+	}
+	if des.Selectors == nil {
+		des.Selectors = make(map[string]*selector_descr)
+	}
+	for k, v := range part.Selectors {
+		if _, y := des.Selectors[k]; !y {
+			des.Selectors[k] = v
+		}
+	}
+	if des.Domains == nil {
+		des.Domains = make(map[string]*domain_descr)
+	}
+	for k, v := range part.Domains {
+		if _, y := des.Domains[k]; !y {
+			des.Domains[k] = v
+		}
+	}
+	des.Zones = append(des.Zones, part.Zones...)
+}
+
+// The relative "@[format:]file_name" is of the directory of included file,
+// the remote lists and other items are kept.
+func resolveListPath(dir, item string) string {
+	if !strings.HasPrefix(item, "@") {
+		return item
+	}
+	var prefix, name = "@", item[1:]
+	if i := strings.IndexByte(name, ':'); i > 0 {
+		if _, y := listFormats[name[:i]]; y {
+			prefix, name = item[:i+2], name[i+1:]
+		}
+	}
+	if isRemoteList(name) || filepath.IsAbs(name) {
+		return item
+	}
+	return prefix + filepath.Join(dir, name)
+}
+
+// Resolve the lists of the included part, the positions of domains are
+// kept for the resolved names.
+func (ck *configChecker) resolveLists(part *config_descr, dir string) {
+	for _, f := range part.Filters {
+		for i, item := range f.Drop {
+			f.Drop[i] = resolveListPath(dir, item)
+		}
+	}
+	for _, sel := range part.Selectors {
+		for i, item := range sel.Routes {
+			sel.Routes[i] = resolveListPath(dir, item)
+		}
+	}
+	for i, item := range part.Zones {
+		part.Zones[i] = resolveListPath(dir, item)
+	}
+	if part.Domains == nil {
+		return
+	}
+	// resolved into a new map, not visiting the resolved keys again
+	var domains = make(map[string]*domain_descr, len(part.Domains))
+	for k, v := range part.Domains {
+		nk := resolveListPath(dir, k)
+		domains[nk] = v
+		if nk == k {
+			continue
+		}
+		if pos, y := ck.positions[itemPath([]interface{}{"domains", k})]; y {
+			ck.positions[itemPath([]interface{}{"domains", nk})] = pos
+		}
+	}
+	part.Domains = domains
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The lists of included file are resolved once, with the relative path of
+// config like "-c dnspanic.conf".
+func TestIncludeListKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnspanic-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var fragment strings.Builder
+	fragment.WriteString("domains {\n")
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("x%d.list", i)
+		if err = ioutil.WriteFile(filepath.Join("conf.d", name), []byte("example.com\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&fragment, "  \"@%s\" {\n    backends = [\"default\"]\n  }\n", name)
+	}
+	fragment.WriteString("  \"plain.example\" {\n    backends = [\"default\"]\n  }\n}\n")
+	var files = map[string]string{
+		"main.conf":        "include = [\"conf.d/*.conf\"]\nbackends {\n  default = [\"udp://127.0.0.1:53\"]\n}\n",
+		"conf.d/part.conf": fragment.String(),
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	des, ck, err := parseConfig("main.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ck.err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(des.Domains) != 41 {
+		t.Fatalf("got %d domains, want 41", len(des.Domains))
+	}
+	for k := range des.Domains {
+		if k == "plain.example" {
+			continue
+		}
+		if _, err := os.Stat(strings.TrimPrefix(k, "@")); err != nil || !strings.HasPrefix(k, "@conf.d/x") {
+			t.Errorf("bad resolved list %q", k)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The formats of included lists, auto detected by lines if not specified
+// like "@hosts:file_name".
+const (
+	listAuto = iota
+	listPlain
+	listHosts
+	listAdblock
+	listDnsmasq
+)
+
+var listFormats = map[string]int{
+	"plain":   listPlain,
+	"hosts":   listHosts,
+	"adblock": listAdblock,
+	"dnsmasq": listDnsmasq,
+}
+
+const (
+	itemRule    = iota // a domain rule, or a plain line
+	itemAllowed        // exception of adblock
+	itemAddress        // the address of domain, from hosts or dnsmasq address=
+	itemServer         // the upstream of domain, from dnsmasq server=
+)
+
+type listItem struct {
+	kind int
+	rule string
+	addr string
+}
+
+const listRecordTTL = 300
+
+// "@[format:]file_name" to format and file name
+func parseListSource(src string) (int, string) {
+	src = strings.TrimPrefix(src, "@")
+	if i := strings.IndexByte(src, ':'); i > 0 {
+		if format, y := listFormats[src[:i]]; y {
+			return format, src[i+1:]
+		}
+	}
+	return listAuto, src
+}
+
+func detectListFormat(line string) int {
+	switch {
+	case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"):
+		return listAdblock
+	case strings.HasPrefix(line, "server=/"), strings.HasPrefix(line, "address=/"):
+		return listDnsmasq
+	}
+	if fields := strings.Fields(line); len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return listHosts
+	}
+	return listPlain
+}
+
+func parseHostsLine(line string, callback func(listItem)) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return
+	}
+	for _, name := range fields[1:] {
+		// localhost, broadcasthost...
+		if strings.Contains(name, ".") {
+			callback(listItem{kind: itemAddress, rule: "=" + name, addr: fields[0]})
+		}
+	}
+}
+
+// ||example.com^ and @@||example.com^, the options after $ are ignored
+func parseAdblockLine(line string, callback func(listItem)) {
+	var kind = itemRule
+	if strings.HasPrefix(line, "@@") {
+		kind, line = itemAllowed, line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return
+	}
+	line = line[2:]
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSuffix(line, "^")
+	if line == "" || strings.ContainsAny(line, "/:^|") {
+		return
+	}
+	callback(listItem{kind: kind, rule: line})
+}
+
+// server=/a.com/b.com/IP[#PORT] and address=/a.com/[IP]
+func parseDnsmasqLine(line string, callback func(listItem)) {
+	var kind int
+	switch {
+	case strings.HasPrefix(line, "server=/"):
+		kind, line = itemServer, line[len("server=/"):]
+	case strings.HasPrefix(line, "address=/"):
+		kind, line = itemAddress, line[len("address=/"):]
+	default:
+		return
+	}
+	parts := strings.Split(line, "/")
+	addr := parts[len(parts)-1]
+	if kind == itemServer && addr == "" {
+		return // local only
+	}
+	if kind == itemServer {
+		host, port := addr, "53"
+		if i := strings.IndexByte(addr, '#'); i >= 0 {
+			host, port = addr[:i], addr[i+1:]
+		}
+		if net.ParseIP(host) == nil {
+			return
+		}
+		addr = "udp://" + net.JoinHostPort(host, port)
+	} else if addr == "#" {
+		addr = ""
+	}
+	for _, name := range parts[:len(parts)-1] {
+		if name != "" {
+			callback(listItem{kind: kind, rule: name, addr: addr})
+		}
+	}
+}
+
+// Read the list of the format, skipping the comments. The remote list is
+// read from the cached copy, and empty if unavailable.
+func readList(lists *listFetcher, src string, callback func(listItem)) {
+	format, name := parseListSource(src)
+	var source = name
+	if isRemoteList(name) {
+		if name = lists.local(name); name == "" {
+			return
+		}
+	}
+	fr, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer fr.Close()
+	var lineNo int
+	defer panicAtLine(source, &lineNo)
+	sc := bufio.NewScanner(fr)
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		lineFormat := format
+		if lineFormat == listAuto {
+			lineFormat = detectListFormat(line)
+		}
+		switch lineFormat {
+		case listHosts:
+			parseHostsLine(line, callback)
+		case listAdblock:
+			parseAdblockLine(line, callback)
+		case listDnsmasq:
+			parseDnsmasqLine(line, callback)
+		default:
+			callback(listItem{kind: itemRule, rule: line})
+		}
+	}
+	if err = sc.Err(); err != nil {
+		panic(err)
+	}
+}
+
+// blocking address in hosts or dnsmasq
+func isNullAddress(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && (ip.IsUnspecified() || ip.IsLoopback())
+}
+
+// The zone record of the address item
+func addressRecord(item listItem) string {
+	name, _ := parseRule(item.rule)
+	rrtype := "A"
+	if ip := net.ParseIP(item.addr); ip != nil && ip.To4() == nil {
+		rrtype = "AAAA"
+	}
+	return fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), listRecordTTL, rrtype, item.addr)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type listen_descr struct {
+	Net        []string
+	Address    string
+	Interface  string
+	Backends   []string
+	Selector   string
+	Prefilters *prefilter_descr
+	Allow      []string
+	Deny       []string
+}
+
+// listener is the policy of a listen block. The addresses are bound on
+// startup, and the policy follows the reloaded config by name.
+type listener struct {
+	name       string
+	nets       []string
+	addrs      []string
+	global     *entry        // the default backends, nil if of config
+	prefilters *prefilterSet // nil if of config
+	acl        *cidrTree     // true for allowed, nil if allowing all
+	others     bool          // allowing the clients not in acl
+}
+
+func (c *config) parseListener(ck *configChecker, name string, d *listen_descr) *listener {
+	var path = func(parts ...interface{}) []interface{} {
+		return append([]interface{}{"listen", name}, parts...)
+	}
+	var l = &listener{name: name, nets: d.Net}
+	if l.nets == nil {
+		l.nets = []string{"udp", "tcp"}
+	}
+	for i, n := range l.nets {
+		switch n {
+		case "udp", "tcp", "tls", "https":
+		default:
+			ck.errorf(path("net", i), "bad net %q", n)
+		}
+	}
+
+	var addr = d.Address
+	if addr == "" {
+		addr = ":53"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	switch {
+	case err != nil:
+		ck.errorf(path("address"), "bad address %q", addr)
+	case d.Interface == "":
+		l.addrs = []string{addr}
+	case host != "":
+		ck.errorf(path("address"), "address %q of interface should be \":PORT\"", addr)
+	default:
+		ips, err := interfaceIPs(d.Interface)
+		if err != nil {
+			ck.errorf(path("interface"), "%v", err)
+		}
+		for _, ip := range ips {
+			l.addrs = append(l.addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	// the default backends of the names without their own
+	if d.Backends != nil || d.Selector != "" {
+		l.global = &entry{scope: name + "|"}
+		for i, str := range d.Backends {
+			bs, y := c.allBackends[str]
+			if !y {
+				ck.errorf(path("backends", i), "unknown backend %q", str)
+			}
+			l.global.backends = append(l.global.backends, bs...)
+		}
+		if d.Selector != "" {
+			if l.global.selector = c.selectors[d.Selector]; l.global.selector == nil {
+				ck.errorf(path("selector"), "unknown selector %q", d.Selector)
+			}
+		}
+	}
+	if d.Prefilters != nil {
+		l.prefilters = c.parsePrefilterSet(ck, path("prefilters"), d.Prefilters)
+	}
+	if d.Allow != nil || d.Deny != nil {
+		l.acl = newCidrTree()
+		l.others = d.Allow == nil
+		for i, a := range d.Allow {
+			ck.try(func() { parseCidrList(l.acl, []string{a}, true) }, path("allow", i)...)
+		}
+		for i, a := range d.Deny {
+			ck.try(func() { parseCidrList(l.acl, []string{a}, false) }, path("deny", i)...)
+		}
+	}
+	return l
+}
+
+// The unicast addresses of the interface, except the link-local ones
+// which require the zone.
+func interfaceIPs(name string) ([]net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipnet, y := a.(*net.IPNet); y && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if ips == nil {
+		return nil, fmt.Errorf("no address of interface %s", name)
+	}
+	return ips, nil
+}
+
+// Whether the client is allowed, the longest prefix of allow and deny wins.
+func (l *listener) allows(addr net.Addr) bool {
+	if l == nil || l.acl == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return false
+	}
+	if _, v, y := l.acl.match(ip); y {
+		return v.(bool)
+	}
+	return l.others
+}
+
+// The prefilters of listener, or of config.
+func (l *listener) prefilterSet(c *config) *prefilterSet {
+	if l == nil || l.prefilters == nil {
+		return c.prefilters
+	}
+	return l.prefilters
+}
+
+// The entry with the default backends of listener, the answers are cached
+// separately.
+func (l *listener) apply(e *entry) *entry {
+	if l == nil || l.global == nil || !e.inherits {
+		return e
+	}
+	var le = *e
+	le.backends, le.selector, le.scope = l.global.backends, l.global.selector, l.global.scope
+	return &le
+}
+
+// Whether the listeners are bound as before, or it takes a restart.
+func sameListenAddrs(a, b *config) bool {
+	if len(a.listeners) != len(b.listeners) {
+		return false
+	}
+	for k, la := range a.listeners {
+		lb := b.listeners[k]
+		if lb == nil || !reflect.DeepEqual(la.nets, lb.nets) || !reflect.DeepEqual(la.addrs, lb.addrs) {
+			return false
+		}
+	}
+	return true
+}
+
+// The servers of listeners in the order of names.
+func newListenServers(c *config, tlsConfig *tls.Config, idle time.Duration) ([]server, error) {
+	var names []string
+	for k := range c.listeners {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var servers []server
+	for _, name := range names {
+		l := c.listeners[name]
+		handler := proxyHandler{listener: name}
+		for _, addr := range l.addrs {
+			for _, n := range l.nets {
+				switch n {
+				case "udp", "tcp":
+					servers = append(servers, newDNSServer(n, addr, handler))
+				case "tls":
+					if tlsConfig == nil {
+						return nil, fmt.Errorf("listen %s requires -cert and -key for tls", name)
+					}
+					servers = append(servers, newStreamServer(addr, handler, tlsConfig, idle))
+				case "https":
+					servers = append(servers, newHttpServer(addr, handler, tlsConfig))
+				}
+				log.Printf("Ready for serving dns on %s %s of listen %s", n, addr, name)
+			}
+		}
+	}
+	return servers, nil
+}
+
+func newDNSServer(network, addr string, handler dns.Handler) server {
+	var srv = &dns.Server{Net: network, Addr: addr, Handler: handler}
+	if network == "udp" {
+		srv.UDPSize = dns.DefaultMsgSize
+	}
+	return srv
+}
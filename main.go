@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,7 +16,6 @@ import (
 )
 
 var (
-	conf   *config
 	rrc    *rrcache
 	qclt   *qClient
 	swcall *singleWayCalling
@@ -26,20 +28,43 @@ func init() {
 func main() {
 	var (
 		localAddr string
+		tlsAddr   string
+		httpsAddr string
+		certFile  string
+		keyFile   string
+		idle      time.Duration
+		adminAddr string
 		cfgPath   string
 		formatCfg bool
+		checkCfg  bool
 	)
 	flag.StringVar(&localAddr, "l", ":53", "local listen address")
+	flag.StringVar(&tlsAddr, "tls", "", "DNS-over-TLS listen address, eg. :853")
+	flag.StringVar(&httpsAddr, "https", "", "DNS-over-HTTPS listen address, plain http if without -cert")
+	flag.StringVar(&certFile, "cert", "", "certificate file of tls/https listener")
+	flag.StringVar(&keyFile, "key", "", "private key file of tls/https listener")
+	flag.DurationVar(&idle, "idle", time.Second*10, "idle timeout of tls connections")
+	flag.StringVar(&adminAddr, "admin", "", "admin http listen address for reloading config, eg. 127.0.0.1:5380")
 	flag.StringVar(&cfgPath, "c", "dnspanic.conf", "config file path")
 	flag.BoolVar(&formatCfg, "format", false, "format config file")
+	flag.BoolVar(&checkCfg, "check", false, "check config file and lists, then exit")
 	flag.Parse()
 	qclt = newQClient()
 	rrc = newRRCache()
-	conf = new(config)
 	swcall = newSingleWayCalling()
-	if err := initialConfig(cfgPath, conf); err != nil {
+	c, err := loadConfig(cfgPath)
+	if checkCfg {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(cfgPath, "is OK")
+		return
+	}
+	if err != nil {
 		log.Fatalln(err)
 	}
+	activeConf.Store(c)
 	if formatCfg {
 		if err := formatConfig(cfgPath); err != nil {
 			log.Fatalln(err)
@@ -47,131 +72,185 @@ func main() {
 		return
 	}
 
-	var failure = make(chan error, 2)
-	var udpServer, tcpServer dns.Server
 	var handler proxyHandler
-	udpServer.Net = "udp"
-	tcpServer.Net = "tcp"
-	udpServer.Handler = handler
-	tcpServer.Handler = handler
-	udpServer.Addr = localAddr
-	tcpServer.Addr = localAddr
-	udpServer.DecorateReader = func(r dns.Reader) dns.Reader {
-		return &decoratedIdleReader{Reader: r}
+	var tlsConfig *tls.Config
+	if certFile != "" || tlsAddr != "" {
+		cr, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tlsConfig = &tls.Config{GetCertificate: cr.GetCertificate}
+	}
+	// the listen blocks replace -l
+	servers, err := newListenServers(c, tlsConfig, idle)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(servers) == 0 {
+		servers = []server{newDNSServer("udp", localAddr, handler), newDNSServer("tcp", localAddr, handler)}
+		log.Println("Ready for serving dns on udp/tcp", localAddr)
+	}
+	if tlsAddr != "" {
+		servers = append(servers, newStreamServer(tlsAddr, handler, tlsConfig, idle))
+		log.Println("Ready for serving dns on tls", tlsAddr)
+	}
+	if httpsAddr != "" {
+		servers = append(servers, newHttpServer(httpsAddr, handler, tlsConfig))
+		log.Println("Ready for serving dns on https", httpsAddr)
+	}
+	if adminAddr != "" {
+		servers = append(servers, newAdminServer(adminAddr, cfgPath))
+		log.Println("Ready for admin on http", adminAddr)
 	}
 
-	go func() { failure <- udpServer.ListenAndServe() }()
-	go func() { failure <- tcpServer.ListenAndServe() }()
+	var failure = make(chan error, len(servers)*2)
+	for _, srv := range servers {
+		go func(srv server) { failure <- srv.ListenAndServe() }(srv)
+	}
 
-	log.Println("Ready for serving dns on udp/tcp", localAddr)
-	waitSignal(failure)
+	waitSignal(failure, len(servers), cfgPath)
 
-	go func() { failure <- tcpServer.Shutdown() }()
-	go func() { failure <- udpServer.Shutdown() }()
+	for _, srv := range servers {
+		go func(srv server) { failure <- srv.Shutdown() }(srv)
+	}
 	qclt.shutdown()
 	// waiting for shutdown
-	<-failure
-	<-failure
-}
-
-type decoratedIdleReader struct {
-	dns.Reader
-	idleCnt int
-}
-
-func (dr *decoratedIdleReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
-	return nil, nil
-}
-
-func (dr *decoratedIdleReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) (b []byte, s *dns.SessionUDP, e error) {
-	b, s, e = dr.Reader.ReadUDP(conn, timeout)
-	if ne, y := e.(*net.OpError); y && ne.Timeout() {
-		dr.idleCnt++
-		if dr.idleCnt&3 == 3 {
-			go qclt.cleanup()
-		}
+	for range servers {
+		<-failure
 	}
-	return
 }
 
-type proxyHandler struct{}
+// proxyHandler serves the queries of the listener, or of -l if unnamed.
+type proxyHandler struct {
+	listener string
+}
 
 func (h proxyHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	// excluding
 	if req.MsgHdr.Response == true || len(req.Question) == 0 {
 		return
 	}
-	// cache first
-	if cc := rrc.get(req); cc != nil {
-		cc.Id = req.Id
-		w.WriteMsg(cc)
+	conf := currentConfig()
+	l, y := conf.listeners[h.listener]
+	// the listener removed by reloading is still bound until restart
+	if h.listener != "" && !y || !l.allows(w.RemoteAddr()) {
+		var resp dns.Msg
+		writeResponse(conf, w, req, resp.SetRcode(req, dns.RcodeRefused))
 		return
 	}
-
-	entry := conf.findEntry(req.Question[0].Name)
+	entry := l.apply(conf.findEntry(req.Question[0].Name, l.prefilterSet(conf)))
 	// prefilter
-	if entry == conf.disabled {
-		dns.HandleFailed(w, req)
+	if entry.block != nil {
+		writeResponse(conf, w, req, entry.block.reply(req))
 		return
 	}
 	if entry.records != nil {
 		resp := entry.resovleReq(req)
 		if resp != nil {
-			w.WriteMsg(resp)
+			writeResponse(conf, w, req, resp)
 			return
 		}
 	}
 
-	result, original := swcall.call(msgKey(req), func() interface{} {
-		var nextReq dns.Msg
-		nextReq.Id = dns.Id()
-		nextReq.RecursionDesired = true
-		nextReq.AuthenticatedData = true
-		nextReq.Question = req.Question
-		nextReq.Extra = opt_hdr
-		return queryBackends(entry, &nextReq)
+	opt := conf.edns.forwardOpt(req)
+	// validating by self, the upstream shouldn't drop the bogus answer
+	validate := conf.validator != nil && !req.CheckingDisabled
+	if validate {
+		opt.SetDo()
+	}
+	subnet := entry.ecs.apply(opt, req, w.RemoteAddr())
+	key := entry.scope + msgKey(req)
+	// cache first
+	if cc := rrc.get(key, subnet); cc != nil {
+		cc.Id = req.Id
+		writeResponse(conf, w, req, cc)
+		return
+	}
+
+	var nextReq dns.Msg
+	nextReq.Id = dns.Id()
+	nextReq.RecursionDesired = true
+	nextReq.AuthenticatedData = true
+	nextReq.CheckingDisabled = req.CheckingDisabled || validate
+	nextReq.Question = req.Question
+	nextReq.Extra = []dns.RR{opt}
+	result, original := swcall.call(key+subnetKey(subnet, 128), func() interface{} {
+		return queryBackends(conf, entry, &nextReq, validate)
 	})
 
 	var resultMsg = result.(*dns.Msg)
 	if resultMsg != nil {
 		// cacheable condition
 		if original && len(resultMsg.Answer) > 0 {
-			rrc.set(resultMsg, 0)
+			rrc.set(key, subnet, resultMsg, 0)
+			if conf.verifier != nil && isDubious(resultMsg) {
+				go conf.verifier.verify(conf, entry, &nextReq, resultMsg, key, subnet)
+			}
 		}
+		// the result is shared by all waiters and cache
+		resultMsg = resultMsg.Copy()
 		resultMsg.Id = req.Id
-		w.WriteMsg(resultMsg)
+		writeResponse(conf, w, req, resultMsg)
 	} else {
 		log.Println("no response for", req.Question[0].Name)
 	}
 }
 
-func queryBackends(entry *entry, nextReq *dns.Msg) *dns.Msg {
+func writeResponse(conf *config, w dns.ResponseWriter, req, resp *dns.Msg) {
+	// the upstream echoed CD of our own when validating
+	resp.CheckingDisabled = req.CheckingDisabled
+	conf.edns.replyOpt(req, resp, conf.maxUDPSize)
+	if _, y := w.RemoteAddr().(*net.UDPAddr); y {
+		resp = truncateMsg(resp, clientUDPSize(req, conf.maxUDPSize))
+	} else {
+		resp.Compress = true
+	}
+	w.WriteMsg(resp)
+}
+
+func queryBackends(conf *config, entry *entry, nextReq *dns.Msg, validate bool) *dns.Msg {
+	if entry.selector != nil {
+		return entry.selector.query(conf, entry, nextReq, validate)
+	}
+	return queryGroup(conf, entry.backends, entry, nextReq, validate)
+}
+
+// try the backends one by one
+func queryGroup(conf *config, backends []*backend, entry *entry, nextReq *dns.Msg, validate bool) *dns.Msg {
 	var tx *transaction
 	var lastMsg *dns.Msg
-	for i, be := range entry.backends {
+	for i, be := range backends {
 		tx = tx.newTransaction(nextReq, entry.filters)
+		tx.checked = validate
+		tx.scope = entry.scope
+		tx.global = conf.global.filters
+		tx.window = be.window
+		if entry.window > 0 && strings.HasPrefix(be.net, "udp") {
+			tx.window = entry.window
+		}
 		qclt.query(be, tx)
-		select {
-		case resultMsg := <-tx.result:
-			if resultMsg != nil {
-				if i == 0 && resultMsg.Rcode != dns.RcodeSuccess {
-					lastMsg = resultMsg
-				} else {
-					return resultMsg
-				}
+		resultMsg := tx.wait(be.timeout + tx.window)
+		if v := conf.validator; resultMsg != nil && validate && v != nil {
+			resultMsg = v.check(entry, nextReq, resultMsg)
+		}
+		if resultMsg != nil {
+			// the failure of first, or the bogus answer of validation
+			if (i == 0 && resultMsg.Rcode != dns.RcodeSuccess) ||
+				(validate && resultMsg.Rcode == dns.RcodeServerFailure) {
+				lastMsg = resultMsg
+			} else {
+				return resultMsg
 			}
-		case <-time.After(_TIMEOUT_2):
-			continue
 		}
 	}
 	return lastMsg
 }
 
-func waitSignal(end chan error) {
+func waitSignal(end chan error, servers int, cfgPath string) {
 	var endCount int
-	var sigChan = make(chan os.Signal)
+	var sigChan = make(chan os.Signal, 1)
 	USR2 := syscall.Signal(12) // fake signal-USR2 for windows
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, USR2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP, USR2)
 
 	for {
 		select {
@@ -180,16 +259,18 @@ func waitSignal(end chan error) {
 			case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
 				log.Println("Terminated by", sig)
 				return
+			case syscall.SIGHUP:
+				if _, err := reloadConfig(cfgPath); err != nil {
+					log.Println("reload config error", err)
+				}
 			default:
 				log.Println("Ingore signal", sig)
 			}
 
 		case err := <-end:
 			endCount++
-			switch endCount {
-			case 1:
-				log.Println(err)
-			default:
+			log.Println(err)
+			if endCount >= servers {
 				return
 			}
 		}
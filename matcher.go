@@ -0,0 +1,278 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// domainMatcher matches the names by rules of four kinds, in the order of
+// precedence: the exact "=example.com" matches the name only, the glob
+// "*.cdn.*.example.com" whose star matches within one label, the regexp
+// "/^ad[0-9]+\./" of the lower-cased name without the last dot, and the
+// suffix "example.com" matches the name and its subdomains, the deepest wins.
+type domainMatcher struct {
+	root    *labelNode // suffix and exact
+	globs   *labelNode
+	regexps []*regexpRule
+	anyRe   *regexp.Regexp // union of regexps for fast rejecting
+	rules   int            // the number of distinct rules
+}
+
+type labelNode struct {
+	children  map[string]*labelNode
+	patterns  []string // the keys of children containing star
+	subtree   interface{}
+	exact     interface{}
+	isSubtree bool
+	isExact   bool
+}
+
+type regexpRule struct {
+	src   string
+	re    *regexp.Regexp
+	value interface{}
+}
+
+const (
+	ruleSuffix = iota
+	ruleRegexp
+	ruleGlob
+	ruleExact
+)
+
+// The rank of rules could be compared across matchers
+func ruleRank(kind, labels int) int {
+	return kind<<16 | labels
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{root: new(labelNode), globs: new(labelNode)}
+}
+
+// Lower-cased and IDNA encoded labels, in the order from the root
+func splitName(name string) []string {
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	for i, label := range labels {
+		labels[i] = labelToASCII(label)
+	}
+	return labels
+}
+
+func normalizeName(name string) string {
+	labels := splitName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// Split "rule, rule, ..." except the regexp which may contain comma
+func splitRules(s string) []string {
+	if _, kind := parseRule(s); kind == ruleRegexp {
+		return []string{s}
+	}
+	return strings.Split(s, ",")
+}
+
+// Parse the rule, returns the name or pattern and the kind
+func parseRule(rule string) (string, int) {
+	rule = strings.TrimSpace(rule)
+	switch {
+	case strings.HasPrefix(rule, "="):
+		return rule[1:], ruleExact
+	case len(rule) > 2 && rule[0] == '/' && rule[len(rule)-1] == '/':
+		return rule[1 : len(rule)-1], ruleRegexp
+	case strings.Contains(rule, "*"):
+		return rule, ruleGlob
+	}
+	return rule, ruleSuffix
+}
+
+func (n *labelNode) node(labels []string, create bool) *labelNode {
+	node := n
+	for _, label := range labels {
+		next := node.children[label]
+		if next == nil {
+			if !create {
+				return nil
+			}
+			if node.children == nil {
+				node.children = make(map[string]*labelNode)
+			}
+			next = new(labelNode)
+			node.children[label] = next
+			if strings.Contains(label, "*") {
+				node.patterns = append(node.patterns, label)
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// The later overwrites the same rule.
+func (m *domainMatcher) insert(rule string, value interface{}) error {
+	name, kind := parseRule(rule)
+	switch kind {
+	case ruleRegexp:
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return err
+		}
+		for _, r := range m.regexps {
+			if r.src == name {
+				r.value = value
+				return nil
+			}
+		}
+		m.regexps = append(m.regexps, &regexpRule{src: name, re: re, value: value})
+		m.anyRe = nil
+		m.rules++
+	case ruleGlob:
+		for _, label := range splitName(name) {
+			if _, err := path.Match(label, ""); err != nil {
+				return err
+			}
+		}
+		node := m.globs.node(splitName(name), true)
+		if !node.isExact {
+			m.rules++
+		}
+		node.exact, node.isExact = value, true
+	case ruleExact:
+		node := m.root.node(splitName(name), true)
+		if !node.isExact {
+			m.rules++
+		}
+		node.exact, node.isExact = value, true
+	default:
+		node := m.root.node(splitName(name), true)
+		if !node.isSubtree {
+			m.rules++
+		}
+		node.subtree, node.isSubtree = value, true
+	}
+	return nil
+}
+
+// The union of regexps, should be called after all inserted.
+func (m *domainMatcher) compile() {
+	if len(m.regexps) == 0 {
+		return
+	}
+	var arr []string
+	for _, r := range m.regexps {
+		arr = append(arr, "(?:"+r.src+")")
+	}
+	m.anyRe = regexp.MustCompile(strings.Join(arr, "|"))
+}
+
+// The value of the rule itself
+func (m *domainMatcher) get(rule string) (interface{}, bool) {
+	name, kind := parseRule(rule)
+	switch kind {
+	case ruleRegexp:
+		for _, r := range m.regexps {
+			if r.src == name {
+				return r.value, true
+			}
+		}
+	case ruleGlob:
+		if node := m.globs.node(splitName(name), false); node != nil && node.isExact {
+			return node.exact, true
+		}
+	case ruleExact:
+		if node := m.root.node(splitName(name), false); node != nil && node.isExact {
+			return node.exact, true
+		}
+	default:
+		if node := m.root.node(splitName(name), false); node != nil && node.isSubtree {
+			return node.subtree, true
+		}
+	}
+	return nil, false
+}
+
+// the literal labels are preferred
+func (n *labelNode) matchGlob(labels []string, literal int) (interface{}, int, bool) {
+	if len(labels) == 0 {
+		return n.exact, literal, n.isExact
+	}
+	if next := n.children[labels[0]]; next != nil {
+		if v, l, y := next.matchGlob(labels[1:], literal+1); y {
+			return v, l, y
+		}
+	}
+	for _, p := range n.patterns {
+		if y, _ := path.Match(p, labels[0]); y {
+			if v, l, y := n.children[p].matchGlob(labels[1:], literal); y {
+				return v, l, y
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// The value of the rule matching the name with the highest rank.
+func (m *domainMatcher) match(name string) (value interface{}, rank int, found bool) {
+	labels := splitName(name)
+	// suffix and exact
+	node := m.root
+	for i := 0; node != nil; i++ {
+		if node.isSubtree {
+			value, rank, found = node.subtree, ruleRank(ruleSuffix, i), true
+		}
+		if i == len(labels) {
+			if node.isExact {
+				return node.exact, ruleRank(ruleExact, i), true
+			}
+			break
+		}
+		node = node.children[labels[i]]
+	}
+	if v, literal, y := m.globs.matchGlob(labels, 0); y {
+		return v, ruleRank(ruleGlob, literal), true
+	}
+	if len(m.regexps) > 0 {
+		var fqdn = strings.TrimSuffix(normalizeName(name), ".")
+		if m.anyRe == nil || m.anyRe.MatchString(fqdn) {
+			for _, r := range m.regexps {
+				if r.re.MatchString(fqdn) {
+					return r.value, ruleRank(ruleRegexp, 0), true
+				}
+			}
+		}
+	}
+	return
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// The IDNA lookup form (UTS #46) of label, or the lower-cased label if
+// it's invalid, eg. the star of globs.
+func labelToASCII(label string) string {
+	if isASCII(label) {
+		return strings.ToLower(label)
+	}
+	if a, err := idna.Lookup.ToASCII(label); err == nil {
+		return a
+	}
+	return strings.ToLower(label)
+}
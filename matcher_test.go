@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+// The rules match on the label boundaries, case-insensitive and in the
+// IDNA lookup form.
+func TestDomainMatcher(t *testing.T) {
+	m := newDomainMatcher()
+	for _, rule := range []string{"example.com", "=exact.example.org", "ＡＢＣ.example", "Mixed.Case.NET", "bücher.example"} {
+		if err := m.insert(rule, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.compile()
+	var tests = []struct {
+		name string
+		rule string // empty if not found
+	}{
+		{"example.com.", "example.com"},
+		{"www.example.com.", "example.com"},
+		{"ample.com.", ""},
+		{"myexample.com.", ""},
+		{"EXAMPLE.Com.", "example.com"},
+		{"exact.example.org.", "=exact.example.org"},
+		{"EXACT.example.org.", "=exact.example.org"},
+		{"www.exact.example.org.", ""},
+		{"abc.example.", "ＡＢＣ.example"},
+		{"x.ABC.example.", "ＡＢＣ.example"},
+		{"mixed.case.net.", "Mixed.Case.NET"},
+		{"www.xn--bcher-kva.example.", "bücher.example"},
+	}
+	for _, tt := range tests {
+		v, _, y := m.match(tt.name)
+		if got, _ := v.(string); y != (tt.rule != "") || got != tt.rule {
+			t.Errorf("%s: matched %q, want %q", tt.name, got, tt.rule)
+		}
+	}
+	if got := normalizeName("ＡＢＣ.Example."); got != "abc.example." {
+		t.Errorf("normalized %q", got)
+	}
+}
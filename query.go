@@ -2,6 +2,7 @@ package main
 
 import (
 	"container/list"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -26,6 +27,12 @@ type backend struct {
 	net  string
 	addr string // with :port
 	url  string
+
+	timeout   time.Duration // waiting for the answer before trying next
+	window    time.Duration // udp only, collecting the replies before accepting
+	tlsConfig *tls.Config   // tls only
+	doh       *dohClient    // https only
+	tcp       *backend      // udp only, retry the truncated answer over tcp
 }
 
 type transaction struct {
@@ -33,9 +40,17 @@ type transaction struct {
 	lastMsg *dns.Msg
 	req     *dns.Msg
 	filters []filter
+	global  []filter // filtering the later answers to cache
+	checked bool     // validating the answer, nothing filtered here
+	scope   string   // of the cache
 	created int64
 	replCnt int32
-	txKey   string // proto+addr+id
+	tcRetry int32 // 1: retrying over tcp, 2: the wait was extended
+
+	window     time.Duration
+	wmu        sync.Mutex
+	candidates []*candidate
+	released   bool
 }
 
 func (tx *transaction) newTransaction(req *dns.Msg, filters []filter) *transaction {
@@ -52,14 +67,45 @@ func (tx *transaction) newTransaction(req *dns.Msg, filters []filter) *transacti
 	return _tx
 }
 
+// Wait for the result, the timeout will be extended once if
+// the answer is being retried over tcp.
+func (t *transaction) wait(timeout time.Duration) *dns.Msg {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-t.result:
+			return msg
+		case <-timer.C:
+			if atomic.CompareAndSwapInt32(&t.tcRetry, 1, 2) {
+				timer.Reset(_TIMEOUT)
+				continue
+			}
+			return nil
+		}
+	}
+}
+
 func (t *transaction) reply(msg *dns.Msg, rtt int, err error, be *backend) {
 	var cnt int32
+	if msg == nil && err != nil {
+		var q = t.req.Question[0]
+		log.Printf("Query [%s %s] @%s err=%v", q.Name, dns.TypeToString[q.Qtype], be.url, err)
+	}
+	// the truncated answer is useless, query again over tcp
+	if msg != nil && msg.Truncated && be.tcp != nil {
+		if atomic.CompareAndSwapInt32(&t.tcRetry, 0, 1) {
+			var q = t.req.Question[0]
+			log.Printf("Query [%s %s] @%s truncated, retry over tcp", q.Name, dns.TypeToString[q.Qtype], be.url)
+			go qclt.query(be.tcp, t)
+		}
+		return
+	}
 	if msg != nil && msg.Response {
 		cnt = atomic.AddInt32(&t.replCnt, 1)
-		if msg.Len() > 512 {
-			// Simply use dns compress to prevent the message larger than 512-bytes
-			msg.Compress = true
-		}
+	}
+	if cnt > 0 && t.window > 0 && t.collect(msg, rtt, be) {
+		return
 	}
 
 	if cnt == 1 {
@@ -70,8 +116,13 @@ func (t *transaction) reply(msg *dns.Msg, rtt int, err error, be *backend) {
 		} else {
 			log.Printf("Query [%s %s] @%s rtt=%d err=%v", q.Name, dns.TypeToString[q.Qtype], be.url, rtt, err)
 		}
-		if msg != nil && len(msg.Answer) > 0 {
-			msg = applyFilters(msg, t.filters)
+		if msg != nil && len(msg.Answer) > 0 && !t.checked {
+			var wait bool
+			if msg, wait = filterMsg(msg, t.filters, secIndeterminate); msg == nil && wait {
+				// rejected, the genuine answer may arrive later
+				atomic.AddInt32(&t.replCnt, -1)
+				return
+			}
 		}
 		// feedback
 		select {
@@ -79,23 +130,32 @@ func (t *transaction) reply(msg *dns.Msg, rtt int, err error, be *backend) {
 		default:
 		}
 
-	} else if cnt > 1 && len(msg.Answer) > 0 {
+	} else if cnt > 1 && len(msg.Answer) > 0 && !t.checked {
 		if lastMsg := t.lastMsg; lastMsg != nil {
 			log.Printf("recv-%d record %s\n previous record %s may be dirty", cnt, msg.Answer, lastMsg.Answer)
 		}
 		// should filter second response
-		msg = applyFilters(msg, conf.global.filters)
+		msg = applyFilters(msg, t.global, secIndeterminate)
 		if msg != nil {
-			rrc.set(msg, 1)
+			rrc.set(t.scope+msgKey(t.req), requestSubnet(t.req), msg, 1)
 		}
 	}
 }
 
-func applyFilters(msg *dns.Msg, filters []filter) *dns.Msg {
+func applyFilters(msg *dns.Msg, filters []filter, security secState) *dns.Msg {
+	msg, _ = filterMsg(msg, filters, security)
+	return msg
+}
+
+// Returns nil if rejected, and whether to wait for another answer.
+func filterMsg(msg *dns.Msg, filters []filter, security secState) (*dns.Msg, bool) {
 	var rrset = msg.Answer
+	var ctx = &filterContext{msg: msg, security: security}
 	// apply filters
 	for _, f := range filters {
-		rrset = f.filter(rrset, msg)
+		if rrset = f.filter(rrset, ctx); len(rrset) == 0 {
+			break
+		}
 	}
 	// all RRs were filtered
 	if len(rrset) == 0 {
@@ -103,7 +163,7 @@ func applyFilters(msg *dns.Msg, filters []filter) *dns.Msg {
 	} else { // write back
 		msg.Answer = rrset
 	}
-	return msg
+	return msg, ctx.wait
 }
 
 // weak equivalent
@@ -124,25 +184,50 @@ var opt_hdr = []dns.RR{
 type qClient struct {
 	cmu     sync.RWMutex
 	tmu     sync.RWMutex
-	txQueue *list.List
+	txQueue *list.List // of *txRecord in the order of registering
 	conns   map[string]*dns.Conn
+	streams map[string]*streamConn
 	txMap   map[string]*transaction
+	stop    chan struct{}
 }
 
+const txCleanupInterval = 4 * time.Second
+
+// The expired transactions are cleaned up periodically, whatever the
+// listeners are.
 func newQClient() *qClient {
-	return &qClient{
+	var q = &qClient{
 		txQueue: list.New(),
 		conns:   make(map[string]*dns.Conn),
+		streams: make(map[string]*streamConn),
 		txMap:   make(map[string]*transaction),
+		stop:    make(chan struct{}),
 	}
+	go func() {
+		ticker := time.NewTicker(txCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				q.cleanup()
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+	return q
 }
 
 func (q *qClient) shutdown() {
+	close(q.stop)
 	q.cmu.Lock()
 	defer q.cmu.Unlock()
 	for _, conn := range q.conns {
 		conn.Close()
 	}
+	for _, sc := range q.streams {
+		sc.Close()
+	}
 }
 
 // get or create
@@ -171,7 +256,8 @@ func (q *qClient) createConnection(be *backend, force bool) (*dns.Conn, error) {
 		return nil, err
 	}
 
-	var conn = &dns.Conn{Conn: udpConn}
+	// large enough for the size advertised in opt_hdr
+	var conn = &dns.Conn{Conn: udpConn, UDPSize: dns.DefaultMsgSize}
 	var existed bool
 	q.cmu.Lock()
 	// recheck map whether the connection has been created.
@@ -201,13 +287,7 @@ func (q *qClient) listen(conn *dns.Conn, be *backend) {
 	for {
 		msg, err = conn.ReadMsg()
 		if msg != nil {
-			txKey := fmt.Sprint(be.url, msg.Id)
-			q.tmu.RLock()
-			tx := q.txMap[txKey]
-			q.tmu.RUnlock()
-			if tx != nil {
-				tx.reply(msg, getRtt(conn), err, be)
-			}
+			q.dispatch(msg, conn, err, be)
 		} else if _, y := err.(*net.OpError); y {
 			conn.Close()
 			time.Sleep(time.Second)
@@ -221,27 +301,37 @@ func (q *qClient) listen(conn *dns.Conn, be *backend) {
 		if conn != nil {
 			break
 		} else {
-			log.Println("create connection remote=%s error=%s", be.addr, err)
+			log.Printf("create connection remote=%s error=%s", be.addr, err)
 			time.Sleep(time.Second * 2)
 		}
 	}
 }
 
-func (q *qClient) requestOverTcp(conn *dns.Conn, be *backend) {
-	defer conn.Close()
-	conn.SetReadDeadline(time.Now().Add(_TIMEOUT))
-	m, err := conn.ReadMsg()
-	if m != nil {
-		txKey := fmt.Sprint(be.url, m.Id)
-		q.tmu.RLock()
-		tx := q.txMap[txKey]
-		q.tmu.RUnlock()
-		if tx != nil {
-			tx.reply(m, getRtt(conn), err, be)
-		}
+// deliver the response to the transaction waiting for it
+func (q *qClient) dispatch(msg *dns.Msg, conn *dns.Conn, err error, be *backend) {
+	txKey := fmt.Sprint(be.url, msg.Id)
+	q.tmu.RLock()
+	tx := q.txMap[txKey]
+	q.tmu.RUnlock()
+	if tx != nil {
+		tx.reply(msg, getRtt(conn), err, be)
 	}
 }
 
+// the key might be registered again by another transaction
+type txRecord struct {
+	key string
+	tx  *transaction
+}
+
+func (q *qClient) register(be *backend, tx *transaction) {
+	txKey := fmt.Sprint(be.url, tx.req.Id)
+	q.tmu.Lock()
+	q.txMap[txKey] = tx
+	q.txQueue.PushBack(&txRecord{txKey, tx})
+	q.tmu.Unlock()
+}
+
 type miekgConn struct {
 	net.Conn                         // a net.Conn holding the connection
 	UDPSize        uint16            // minimum receive buffer for UDP messages
@@ -257,35 +347,21 @@ func getRtt(c *dns.Conn) int {
 }
 
 func (q *qClient) query(be *backend, tx *transaction) {
-	var conn *dns.Conn
-	var isTcpConn bool
-	var err error
-	if strings.HasPrefix(be.net, "udp") {
-		conn, err = q.getConnection(be)
-	} else {
-		conn, err = dns.DialTimeout(be.net, be.addr, _TIMEOUT_1)
-		isTcpConn = true
-	}
-
-	if conn == nil {
-		tx.reply(nil, 0, err, be)
-		return
-	}
-
-	req := tx.req
-	txKey := fmt.Sprint(be.url, req.Id)
-	q.tmu.Lock()
-	tx.txKey = txKey
-	q.txMap[txKey] = tx
-	q.txQueue.PushBack(tx)
-	q.tmu.Unlock()
-
-	if isTcpConn {
-		go q.requestOverTcp(conn, be)
+	switch {
+	case be.doh != nil:
+		go q.queryOverHttps(be, tx)
+	case strings.HasPrefix(be.net, "udp"):
+		conn, err := q.getConnection(be)
+		if conn == nil {
+			tx.reply(nil, 0, err, be)
+			return
+		}
+		q.register(be, tx)
+		conn.SetWriteDeadline(time.Now().Add(_TIMEOUT_1))
+		conn.WriteMsg(tx.req)
+	default: // tcp, tls
+		q.queryOverStream(be, tx)
 	}
-	conn.SetWriteDeadline(time.Now().Add(_TIMEOUT_1))
-	conn.WriteMsg(req)
-	return
 }
 
 func (q *qClient) cleanup() {
@@ -293,11 +369,13 @@ func (q *qClient) cleanup() {
 	defer q.tmu.Unlock()
 	now := time.Now().Unix()
 	for e := q.txQueue.Front(); e != nil; {
-		tx := e.Value.(*transaction)
-		if now-tx.created > 3 {
+		r := e.Value.(*txRecord)
+		if now-r.tx.created > 3 {
 			next := e.Next()
 			q.txQueue.Remove(e)
-			delete(q.txMap, tx.txKey)
+			if q.txMap[r.key] == r.tx {
+				delete(q.txMap, r.key)
+			}
 			e = next
 		} else {
 			break
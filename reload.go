@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The config in use, swapped as a whole on reload. The queries in flight
+// keep the config they started with, it's passed down from ServeDNS.
+var activeConf atomic.Value // *config
+
+var reloadMu sync.Mutex
+
+func currentConfig() *config {
+	return activeConf.Load().(*config)
+}
+
+// Parse the config file and the lists again, the current config is kept
+// if any error. Returns the summary of changes.
+func reloadConfig(file string) (string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := loadConfig(file)
+	if err != nil {
+		return "", err
+	}
+	old := currentConfig()
+	c.inheritBackends(old)
+	c.inheritLearned(old)
+	activeConf.Store(c)
+	close(old.done)
+	summary := diffConfig(old, c)
+	log.Println("config reloaded:", summary)
+	if !sameListenAddrs(old, c) {
+		log.Println("the addresses of listeners take effect after restart, the removed ones refuse queries")
+	}
+	return summary, nil
+}
+
+// Reuse the DoH clients of the unchanged backends, keeping their connections.
+// The udp/tcp/tls connections are shared by url already.
+func (c *config) inheritBackends(old *config) {
+	var clients = make(map[string]*dohClient)
+	for _, group := range old.allBackends {
+		for _, be := range group {
+			if be.doh != nil {
+				clients[be.url] = be.doh
+			}
+		}
+	}
+	for _, group := range c.allBackends {
+		for _, be := range group {
+			dc := clients[be.url]
+			if be.doh == nil || dc == nil {
+				continue
+			}
+			if dc.get == be.doh.get && dc.client.Timeout == be.doh.client.Timeout &&
+				reflect.DeepEqual(dc.bootstrap, be.doh.bootstrap) {
+				be.doh = dc
+			}
+		}
+	}
+}
+
+// eg. "backends +new -old ~default"
+func diffSection(name string, a, b interface{}) string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var changes []string
+	for _, k := range vb.MapKeys() {
+		if v := va.MapIndex(k); !v.IsValid() {
+			changes = append(changes, "+"+k.String())
+		} else if !reflect.DeepEqual(v.Interface(), vb.MapIndex(k).Interface()) {
+			changes = append(changes, "~"+k.String())
+		}
+	}
+	for _, k := range va.MapKeys() {
+		if !vb.MapIndex(k).IsValid() {
+			changes = append(changes, "-"+k.String())
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	sort.Strings(changes)
+	return name + " " + strings.Join(changes, " ")
+}
+
+func diffConfig(old, c *config) string {
+	a, b := old.descr, c.descr
+	var parts []string
+	for _, s := range []string{
+		diffSection("backends", a.Backends, b.Backends),
+		diffSection("filters", a.Filters, b.Filters),
+		diffSection("selectors", a.Selectors, b.Selectors),
+		diffSection("domains", a.Domains, b.Domains),
+		diffSection("listen", a.Listen, b.Listen),
+	} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	var sections = []struct {
+		name string
+		a, b interface{}
+	}{
+		{"prefilters", a.Prefilters, b.Prefilters},
+		{"zones", a.Zones, b.Zones},
+		{"bootstrap", a.Bootstrap, b.Bootstrap},
+		{"max_udp_size", a.MaxUDPSize, b.MaxUDPSize},
+		{"edns", a.Edns, b.Edns},
+		{"dnssec", a.Dnssec, b.Dnssec},
+		{"verify", a.Verify, b.Verify},
+		{"include", a.Include, b.Include},
+	}
+	for _, s := range sections {
+		if !reflect.DeepEqual(s.a, s.b) {
+			parts = append(parts, s.name+" changed")
+		}
+	}
+	// the rules of lists
+	var pa = old.prefilters.matcher.Load().(*prefilterRules).rules()
+	var pb = c.prefilters.matcher.Load().(*prefilterRules).rules()
+	if old.entries.rules != c.entries.rules {
+		parts = append(parts, fmt.Sprintf("domain rules %d -> %d", old.entries.rules, c.entries.rules))
+	}
+	if pa != pb {
+		parts = append(parts, fmt.Sprintf("prefilter rules %d -> %d", pa, pb))
+	}
+	if len(parts) == 0 {
+		return "no change"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// adminServer triggers reloading by "POST /reload", should listen on the
+// loopback only.
+type adminServer struct {
+	http.Server
+	cfgPath string
+}
+
+func newAdminServer(addr, cfgPath string) *adminServer {
+	s := &adminServer{cfgPath: cfgPath}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", s.serveReload)
+	s.Addr = addr
+	s.Handler = mux
+	return s
+}
+
+func (s *adminServer) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	summary, err := reloadConfig(s.cfgPath)
+	if err != nil {
+		log.Println("reload config error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fmt.Fprintln(w, summary)
+}
+
+func (s *adminServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), _TIMEOUT*2)
+	defer cancel()
+	return s.Server.Shutdown(ctx)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultListRefresh = 24 * time.Hour
+	defaultListMaxSize = 32 << 20
+)
+
+// listFetcher downloads the remote lists into the cache directory, then
+// the lists are read from the cached copies. Each config has its own, so
+// the settings take effect only if the config is accepted.
+type listFetcher struct {
+	dir     string
+	maxSize int64
+	client  *http.Client
+}
+
+// The cached copies could be shared by the fetchers of the old and new
+// config, the downloads are not serialized.
+var listCacheMu sync.Mutex
+
+type listMeta struct {
+	URL          string
+	ETag         string
+	LastModified string
+	Checksum     string // sha256 of the cached copy
+}
+
+var listClient = &http.Client{Timeout: time.Minute}
+
+func isRemoteList(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+func newListFetcher(dir string, maxSize int) *listFetcher {
+	var f = &listFetcher{
+		dir:     filepath.Join(os.TempDir(), "dnspanic-lists"),
+		maxSize: defaultListMaxSize,
+		client:  listClient,
+	}
+	if dir != "" {
+		f.dir = dir
+	}
+	if maxSize > 0 {
+		f.maxSize = int64(maxSize)
+	}
+	return f
+}
+
+func (f *listFetcher) cachePath(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:])+".list")
+}
+
+func (f *listFetcher) loadMeta(path string) *listMeta {
+	var meta = new(listMeta)
+	buf, err := ioutil.ReadFile(path + ".meta")
+	if err != nil || json.Unmarshal(buf, meta) != nil {
+		return nil
+	}
+	// the cached copy must be intact
+	buf, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if sum := sha256.Sum256(buf); hex.EncodeToString(sum[:]) != meta.Checksum {
+		return nil
+	}
+	return meta
+}
+
+// write to temporary file then rename
+func writeFileAtomic(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// The path of cached copy, fetching it if not cached yet. Empty if
+// neither available.
+func (f *listFetcher) local(url string) string {
+	path := f.cachePath(url)
+	listCacheMu.Lock()
+	meta := f.loadMeta(path)
+	listCacheMu.Unlock()
+	if meta != nil {
+		return path
+	}
+	if _, err := f.fetch(url); err != nil {
+		log.Printf("fetch list %s error=%v", url, err)
+		return ""
+	}
+	return path
+}
+
+// Refresh the cached copy, returns whether the content changed.
+// The lock is held on reading and writing the cache, not downloading.
+func (f *listFetcher) fetch(url string) (bool, error) {
+	path := f.cachePath(url)
+	listCacheMu.Lock()
+	meta := f.loadMeta(path)
+	listCacheMu.Unlock()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	if meta != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && meta != nil:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > f.maxSize {
+		return false, fmt.Errorf("larger than %d bytes", f.maxSize)
+	}
+	if len(buf) == 0 {
+		return false, errors.New("empty list")
+	}
+	listCacheMu.Lock()
+	defer listCacheMu.Unlock()
+	if err = os.MkdirAll(f.dir, 0755); err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(buf)
+	var newMeta = &listMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Checksum:     hex.EncodeToString(sum[:]),
+	}
+	var changed = meta == nil || meta.Checksum != newMeta.Checksum
+	if changed {
+		if err = writeFileAtomic(path, buf); err != nil {
+			return false, err
+		}
+	}
+	mbuf, _ := json.Marshal(newMeta)
+	return changed, writeFileAtomic(path+".meta", mbuf)
+}
+
+// The remote lists included by prefilters
+func remotePrefilterLists(f *prefilter_descr) []string {
+	var urls []string
+	for _, name := range append(append([]string{}, f.Disabled...), f.Allowed...) {
+		if strings.HasPrefix(name, "@") {
+			if _, src := parseListSource(name); isRemoteList(src) {
+				urls = append(urls, src)
+			}
+		}
+	}
+	return urls
+}
+
+// Refresh the remote lists of prefilters periodically, the prefilters
+// are rebuilt and swapped if any list changed.
+func (p *prefilterSet) refreshLists(done chan struct{}) {
+	urls := remotePrefilterLists(p.descr)
+	for {
+		var changed bool
+		for _, url := range urls {
+			y, err := p.lists.fetch(url)
+			if err != nil {
+				// keep the cached copy
+				log.Printf("refresh list %s error=%v", url, err)
+			}
+			changed = changed || y
+		}
+		if changed {
+			p.rebuild()
+		}
+		select {
+		case <-time.After(p.refresh):
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *prefilterSet) rebuild() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("rebuild prefilters error", e)
+		}
+	}()
+	var m = newPrefilterRules()
+	parsePrefilters(nil, p.lists, nil, p.descr, m)
+	m.compile()
+	p.matcher.Store(m)
+	log.Println("prefilters rebuilt")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// selector queries the domestic and foreign backends in parallel like
+// ChinaDNS. The domestic answer is accepted only if all the addresses of
+// it are located in the routes, otherwise the foreign answer wins.
+type selector struct {
+	domestic []*backend
+	foreign  []*backend
+	routes   *cidrTree
+}
+
+// Returns nil if any error.
+func (c *config) parseSelector(ck *configChecker, name string, d *selector_descr) *selector {
+	var s = &selector{routes: newCidrTree()}
+	var ok = true
+	var groups = func(field string, labels []string) []*backend {
+		var bs []*backend
+		for i, str := range labels {
+			if c.allBackends[str] == nil {
+				ck.errorf([]interface{}{"selectors", name, field, i}, "unknown backend %q", str)
+				ok = false
+			}
+			bs = append(bs, c.allBackends[str]...)
+		}
+		return bs
+	}
+	s.domestic = groups("domestic", d.Domestic)
+	s.foreign = groups("foreign", d.Foreign)
+	if ok && (s.domestic == nil || s.foreign == nil) {
+		ck.errorf([]interface{}{"selectors", name}, "selector %s requires domestic and foreign", name)
+		ok = false
+	}
+	for i, a := range d.Routes {
+		ok = ck.try(func() { parseCidrList(s.routes, []string{a}, true) }, "selectors", name, "routes", i) && ok
+	}
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// whether the answer is a domestic one
+func (s *selector) located(msg *dns.Msg) bool {
+	if msg == nil || len(msg.Answer) == 0 {
+		return false
+	}
+	for _, rr := range msg.Answer {
+		if answerIP(rr) == nil {
+			continue
+		}
+		if !s.routes.containsAnswer(rr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *selector) query(conf *config, entry *entry, nextReq *dns.Msg, validate bool) *dns.Msg {
+	var foreignReq = nextReq.Copy()
+	foreignReq.Id = dns.Id()
+	var foreign = make(chan *dns.Msg, 1)
+	go func() {
+		foreign <- queryGroup(conf, s.foreign, entry, foreignReq, validate)
+	}()
+
+	var q = nextReq.Question[0]
+	domestic := queryGroup(conf, s.domestic, entry, nextReq, validate)
+	if s.located(domestic) {
+		log.Printf("\tselect [%s %s] domestic", q.Name, dns.TypeToString[q.Qtype])
+		return domestic
+	}
+	if msg := <-foreign; msg != nil {
+		log.Printf("\tselect [%s %s] foreign", q.Name, dns.TypeToString[q.Qtype])
+		return msg
+	}
+	log.Printf("\tselect [%s %s] domestic, foreign failed", q.Name, dns.TypeToString[q.Qtype])
+	return domestic
+}
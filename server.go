@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	certCheckInterval = time.Second * 10
+	maxPipelined      = 64 // outstanding queries per connection
+)
+
+type server interface {
+	ListenAndServe() error
+	Shutdown() error
+}
+
+// certReloader loads the certificate again once the files were modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (cr *certReloader) load() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.checked = time.Now()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) > certCheckInterval {
+		cr.checked = time.Now()
+		if modTime, err := cr.lastModified(); err == nil && !modTime.Equal(cr.modTime) {
+			if err = cr.load(); err != nil {
+				log.Println("reload certificate error", err)
+			} else {
+				log.Println("reloaded certificate", cr.certFile)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// streamServer serves DNS-over-TLS (RFC 7858). Unlike the dns.Server, the
+// queries pipelined on a connection are handled concurrently and answered
+// out-of-order (RFC 7766).
+type streamServer struct {
+	addr        string
+	handler     dns.Handler
+	tlsConfig   *tls.Config
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+func newStreamServer(addr string, handler dns.Handler, tlsConfig *tls.Config, idle time.Duration) *streamServer {
+	return &streamServer{
+		addr:        addr,
+		handler:     handler,
+		tlsConfig:   tlsConfig,
+		idleTimeout: idle,
+		conns:       make(map[net.Conn]bool),
+	}
+}
+
+func (s *streamServer) ListenAndServe() error {
+	l, err := tls.Listen("tcp", s.addr, s.tlsConfig)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errors.New("server closed")
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, y := err.(net.Error); y && ne.Temporary() {
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *streamServer) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener == nil {
+		return errors.New("server not started")
+	}
+	return s.listener.Close()
+}
+
+func (s *streamServer) serve(conn net.Conn) {
+	var wg sync.WaitGroup
+	var sema = make(chan bool, maxPipelined)
+	var w = &streamWriter{conn: conn}
+	defer func() {
+		// answer the outstanding queries before closing
+		wg.Wait()
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		buf, err := readStreamMsg(conn)
+		if err != nil {
+			return
+		}
+		var req = new(dns.Msg)
+		if req.Unpack(buf) != nil {
+			return
+		}
+		sema <- true
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+			s.handler.ServeDNS(w, req)
+		}()
+	}
+}
+
+func readStreamMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(l[:])
+	if length < 12 {
+		return nil, dns.ErrShortRead
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// streamWriter is shared by the concurrent handlers of a connection.
+type streamWriter struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (w *streamWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *streamWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+func (w *streamWriter) TsigStatus() error    { return nil }
+func (w *streamWriter) TsigTimersOnly(bool)  {}
+func (w *streamWriter) Hijack()              {}
+func (w *streamWriter) Close() error         { return w.conn.Close() }
+
+func (w *streamWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func (w *streamWriter) Write(m []byte) (int, error) {
+	if len(m) > dns.MaxMsgSize {
+		return 0, errors.New("message too large")
+	}
+	var buf = make([]byte, 2, len(m)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(m)))
+	buf = append(buf, m...)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(_TIMEOUT * 2))
+	_, err := w.conn.Write(buf)
+	return len(m), err
+}
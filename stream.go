@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// default idle timeout of pooled connections, until the server tells its own.
+const streamIdleTimeout = time.Second * 10
+
+// streamConn is a long-lived connection to a stream backend (tcp/tls).
+// Queries are pipelined on it and responses are matched by id (RFC 7766).
+type streamConn struct {
+	*dns.Conn
+	wmu  sync.Mutex
+	idle int64 // time.Duration, updated by edns-tcp-keepalive
+}
+
+func (sc *streamConn) idleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sc.idle))
+}
+
+func (sc *streamConn) writeMsg(m *dns.Msg) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.SetWriteDeadline(time.Now().Add(_TIMEOUT_1))
+	// keep the connection for the answer
+	sc.SetReadDeadline(time.Now().Add(sc.idleTimeout() + _TIMEOUT))
+	return sc.WriteMsg(withKeepalive(m))
+}
+
+// The EDNS0_TCP_KEEPALIVE of the vendored dns package packs the option
+// header twice, so the option is handled as an EDNS0_LOCAL here.
+func withKeepalive(req *dns.Msg) *dns.Msg {
+	var m = *req
+	var keepalive = &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE}
+	var found bool
+	m.Extra = make([]dns.RR, 0, len(req.Extra)+1)
+	// don't modify the shared request
+	for _, rr := range req.Extra {
+		if opt, y := rr.(*dns.OPT); y {
+			var o = *opt
+			o.Option = append(opt.Option[:len(opt.Option):len(opt.Option)], keepalive)
+			rr, found = &o, true
+		}
+		m.Extra = append(m.Extra, rr)
+	}
+	if !found {
+		var o = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		o.SetUDPSize(dns.DefaultMsgSize)
+		o.Option = []dns.EDNS0{keepalive}
+		m.Extra = append(m.Extra, o)
+	}
+	return &m
+}
+
+// Take out the keepalive option of response, returns the timeout
+// advertised by server or zero.
+func takeKeepalive(m *dns.Msg) time.Duration {
+	var opt = m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	var timeout time.Duration
+	var options = opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			if l, y := o.(*dns.EDNS0_LOCAL); y && len(l.Data) == 2 {
+				timeout = time.Duration(binary.BigEndian.Uint16(l.Data)) * time.Millisecond * 100
+			}
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return timeout
+}
+
+// get or dial
+func (q *qClient) getStream(be *backend) (*streamConn, error) {
+	q.cmu.RLock()
+	if sc, y := q.streams[be.url]; y {
+		q.cmu.RUnlock()
+		return sc, nil
+	}
+	q.cmu.RUnlock()
+	return q.createStream(be)
+}
+
+func (q *qClient) createStream(be *backend) (*streamConn, error) {
+	var d = net.Dialer{Timeout: _TIMEOUT}
+	var c net.Conn
+	var err error
+	if be.tlsConfig != nil {
+		c, err = tls.DialWithDialer(&d, "tcp", be.addr, be.tlsConfig)
+	} else {
+		c, err = d.Dial(be.net, be.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sc = &streamConn{
+		Conn: &dns.Conn{Conn: c},
+		idle: int64(streamIdleTimeout),
+	}
+	q.cmu.Lock()
+	// recheck map whether the connection has been created.
+	if old, y := q.streams[be.url]; y {
+		q.cmu.Unlock()
+		c.Close()
+		return old, nil
+	}
+	q.streams[be.url] = sc
+	q.cmu.Unlock()
+	go q.listenStream(sc, be)
+	return sc, nil
+}
+
+// forget the broken connection, next query will dial a new one.
+func (q *qClient) removeStream(sc *streamConn, be *backend) {
+	q.cmu.Lock()
+	if q.streams[be.url] == sc {
+		delete(q.streams, be.url)
+	}
+	q.cmu.Unlock()
+	sc.Close()
+}
+
+func (q *qClient) listenStream(sc *streamConn, be *backend) {
+	for {
+		msg, err := sc.ReadMsg()
+		if msg != nil {
+			if idle := takeKeepalive(msg); idle > 0 {
+				atomic.StoreInt64(&sc.idle, int64(idle))
+			}
+			q.dispatch(msg, sc.Conn, err, be)
+		} else if err != nil {
+			// idle timeout or remote closed the idle connection is the usual case
+			if ne, y := err.(net.Error); err != io.EOF && (!y || !ne.Timeout()) {
+				log.Printf("listen remote=%s error=%s", be.url, err)
+			}
+			break
+		}
+	}
+	q.removeStream(sc, be)
+}
+
+func (q *qClient) queryOverStream(be *backend, tx *transaction) {
+	var err error
+	// a pooled connection may have been closed by remote silently,
+	// then retry once with a fresh one.
+	for i := 0; i < 2; i++ {
+		var sc *streamConn
+		sc, err = q.getStream(be)
+		if sc == nil {
+			break
+		}
+		q.register(be, tx)
+		if err = sc.writeMsg(tx.req); err == nil {
+			return
+		}
+		q.removeStream(sc, be)
+	}
+	tx.reply(nil, 0, err, be)
+}
+
+// Build the tls config of a backend, the servername overrides the SNI and
+// the name to be verified, pins are base64 encoded sha256 of SPKI.
+func newBackendTLSConfig(servername string, pins []string) (*tls.Config, error) {
+	var pinSet = make(map[string]bool)
+	for _, p := range pins {
+		raw, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, errors.New("bad pin " + p)
+		}
+		pinSet[string(raw)] = true
+	}
+	cfg := &tls.Config{
+		ServerName:         servername,
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+	if len(pinSet) > 0 {
+		// called after the normal verification of certificate chains
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pinSet[string(sum[:])] {
+					return nil
+				}
+			}
+			return errors.New("no certificate matched the pinned keys")
+		}
+	}
+	return cfg, nil
+}
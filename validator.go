@@ -0,0 +1,671 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type secState int
+
+const (
+	secIndeterminate secState = iota
+	secInsecure
+	secSecure
+	secBogus
+)
+
+var secStateNames = [...]string{"indeterminate", "insecure", "secure", "bogus"}
+
+func (s secState) String() string { return secStateNames[s] }
+
+// The DS of root KSK-2017 and KSK-2024
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	zoneSecure   = iota // a signed zone with the validated keys
+	zoneInsecure        // a delegation proven without DS
+	zoneNotCut          // not a zone cut, belongs to parent zone
+	zoneBogus
+)
+
+type zoneInfo struct {
+	kind    int
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// validator walks the chain of trust from the trust anchors (RFC 4035),
+// the DS/DNSKEY records are queried via the backends of domain entry.
+type validator struct {
+	anchors  map[string][]*dns.DS
+	mu       sync.Mutex
+	zones    map[string]*zoneInfo
+	exchange func(*entry, *dns.Msg) *dns.Msg
+}
+
+func newValidator(conf *config, anchors []string) (*validator, error) {
+	v := &validator{
+		anchors: make(map[string][]*dns.DS),
+		zones:   make(map[string]*zoneInfo),
+		exchange: func(e *entry, req *dns.Msg) *dns.Msg {
+			return queryBackends(conf, e, req, false)
+		},
+	}
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+	for _, a := range anchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, err
+		}
+		ds, y := rr.(*dns.DS)
+		if !y {
+			return nil, errors.New("trust anchor must be DS " + a)
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	return v, nil
+}
+
+func (v *validator) lookup(entry *entry, name string, qtype uint16) *dns.Msg {
+	var req dns.Msg
+	req.Id = dns.Id()
+	req.SetQuestion(name, qtype)
+	req.CheckingDisabled = true
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	return v.exchange(entry, &req)
+}
+
+func (v *validator) getZone(name string) *zoneInfo {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if z := v.zones[name]; z != nil && time.Now().Before(z.expires) {
+		return z
+	}
+	return nil
+}
+
+func (v *validator) setZone(name string, z *zoneInfo, ttl uint32) {
+	if ttl < 60 {
+		ttl = 60
+	} else if ttl > 3600 {
+		ttl = 3600
+	}
+	z.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	v.mu.Lock()
+	v.zones[name] = z
+	v.mu.Unlock()
+}
+
+// split the records into rrsets and their signatures
+func groupRRsets(rrs []dns.RR) (sets [][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	var index = make(map[string]int)
+	sigs = make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if sig, y := rr.(*dns.RRSIG); y {
+			key := fmt.Sprint(name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := fmt.Sprint(name, h.Rrtype)
+		if i, y := index[key]; y {
+			sets[i] = append(sets[i], rr)
+		} else {
+			index[key] = len(sets)
+			sets = append(sets, []dns.RR{rr})
+		}
+	}
+	return
+}
+
+func rrsetKey(rrset []dns.RR) string {
+	h := rrset[0].Header()
+	return fmt.Sprint(strings.ToLower(h.Name), h.Rrtype)
+}
+
+func minRRsetTTL(rrset []dns.RR) uint32 {
+	var ttl uint32 = 3600
+	for _, rr := range rrset {
+		if t := rr.Header().Ttl; t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+// verify any of signatures with any of keys
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(time.Time{}) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, rrset) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the DNSKEY rrset signed by a key matching the DS
+func verifyKeys(keyset []dns.RR, sigs []*dns.RRSIG, dsset []*dns.DS) []*dns.DNSKEY {
+	var keys, matched []*dns.DNSKEY
+	for _, rr := range keyset {
+		if k, y := rr.(*dns.DNSKEY); y {
+			keys = append(keys, k)
+		}
+	}
+	for _, ds := range dsset {
+		for _, k := range keys {
+			if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+				continue
+			}
+			if d := k.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+				matched = append(matched, k)
+			}
+		}
+	}
+	if len(matched) > 0 && verifyRRset(keyset, sigs, matched) {
+		return keys
+	}
+	return nil
+}
+
+// Fetch and validate the DNSKEY of zone with the DS.
+func (v *validator) fetchKeys(entry *entry, zone string, dsset []*dns.DS) ([]*dns.DNSKEY, uint32) {
+	resp := v.lookup(entry, zone, dns.TypeDNSKEY)
+	if resp == nil {
+		return nil, 0
+	}
+	sets, sigs := groupRRsets(resp.Answer)
+	for _, set := range sets {
+		if set[0].Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(set[0].Header().Name, zone) {
+			return verifyKeys(set, sigs[rrsetKey(set)], dsset), minRRsetTTL(set)
+		}
+	}
+	return nil, 0
+}
+
+// Whether the denial proves that name is a delegation without DS.
+func provesInsecureDelegation(ns []dns.RR, name string) (insecure, cut bool) {
+	for _, rr := range ns {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(r.Hdr.Name, name) {
+				cut = hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeSOA)
+				return cut && !hasType(r.TypeBitMap, dns.TypeDS), cut
+			}
+		case *dns.NSEC3:
+			if r.Match(name) {
+				cut = hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeSOA)
+				return cut && !hasType(r.TypeBitMap, dns.TypeDS), cut
+			}
+			// opt-out span may contain insecure delegations
+			if r.Flags&1 == 1 && r.Cover(name) {
+				insecure = true
+			}
+		}
+	}
+	return insecure, insecure
+}
+
+// Inspect the zone cut at name, the parent is known to be secure with keys.
+func (v *validator) probeCut(entry *entry, name string, parentKeys []*dns.DNSKEY) *zoneInfo {
+	if z := v.getZone(name); z != nil {
+		return z
+	}
+	var z = &zoneInfo{kind: zoneBogus}
+	var ttl uint32 = 60
+	defer func() { v.setZone(name, z, ttl) }()
+
+	if dsset := v.anchors[name]; dsset != nil {
+		if z.keys, ttl = v.fetchKeys(entry, name, dsset); z.keys != nil {
+			z.kind = zoneSecure
+		}
+		return z
+	}
+
+	resp := v.lookup(entry, name, dns.TypeDS)
+	if resp == nil {
+		return z
+	}
+	// validate everything with the parent keys, only the verified
+	// NSEC/NSEC3 could prove the delegation insecure
+	sets, sigs := groupRRsets(append(resp.Answer, resp.Ns...))
+	var dsset []*dns.DS
+	var proofs []dns.RR
+	for _, set := range sets {
+		h := set[0].Header()
+		if h.Rrtype == dns.TypeCNAME && strings.EqualFold(h.Name, name) {
+			z.kind = zoneNotCut // an alias is never a zone cut
+			return z
+		}
+		if h.Rrtype == dns.TypeSOA || h.Rrtype == dns.TypeNS {
+			continue
+		}
+		if !verifyRRset(set, sigs[rrsetKey(set)], parentKeys) {
+			// the child answers, it may be a zone apex of the same server
+			if h.Rrtype != dns.TypeDS {
+				continue
+			}
+			return z
+		}
+		switch {
+		case h.Rrtype == dns.TypeDS && strings.EqualFold(h.Name, name):
+			ttl = minRRsetTTL(set)
+			for _, rr := range set {
+				dsset = append(dsset, rr.(*dns.DS))
+			}
+		case h.Rrtype == dns.TypeNSEC || h.Rrtype == dns.TypeNSEC3:
+			proofs = append(proofs, set...)
+		}
+	}
+	if dsset != nil {
+		if z.keys, ttl = v.fetchKeys(entry, name, dsset); z.keys != nil {
+			z.kind = zoneSecure
+		}
+		return z
+	}
+	// no DS without the validated proof
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError || proofs == nil {
+		return z
+	}
+	if insecure, cut := provesInsecureDelegation(proofs, name); insecure {
+		z.kind = zoneInsecure
+	} else if !cut {
+		z.kind = zoneNotCut
+	}
+	return z
+}
+
+// Walk down from the root to the zone containing name, returns the
+// security state and keys of that zone.
+func (v *validator) closestZone(entry *entry, name string) (secState, []*dns.DNSKEY) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	var keys []*dns.DNSKEY
+	var trusted bool
+	for i := len(labels); i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !trusted && v.anchors[zone] == nil {
+			continue
+		}
+		z := v.probeCut(entry, zone, keys)
+		switch z.kind {
+		case zoneSecure:
+			keys, trusted = z.keys, true
+		case zoneInsecure:
+			return secInsecure, nil
+		case zoneBogus:
+			return secBogus, nil
+		}
+	}
+	if !trusted {
+		return secIndeterminate, nil
+	}
+	return secSecure, keys
+}
+
+// Validate the answer or the denial of response. All the rrsets must be
+// verified with the keys of the signer zones. The unsigned rrsets are
+// accepted only if they are proven to be under an insecure delegation.
+// The secure denial must be proven by the NSEC/NSEC3 of the name.
+func (v *validator) validate(entry *entry, resp *dns.Msg) secState {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return secIndeterminate
+	}
+	target, denial := denialTarget(resp)
+	var section = resp.Answer
+	if denial {
+		section = append(append([]dns.RR{}, resp.Answer...), resp.Ns...)
+	}
+	sets, sigs := groupRRsets(section)
+	if len(sets) == 0 {
+		state, _ := v.closestZone(entry, resp.Question[0].Name)
+		if state == secSecure { // an unsigned denial
+			return secBogus
+		}
+		return state
+	}
+
+	var result = secSecure
+	var expanded = make(map[string]int) // the wildcard answers to the labels of source
+	for _, set := range sets {
+		state := v.validateRRset(entry, set, sigs[rrsetKey(set)])
+		if state > result || (state != secSecure && result == secSecure) {
+			result = state
+		}
+		if result == secBogus {
+			break
+		}
+		if labels, y := wildcardLabels(set[0].Header().Name, sigs[rrsetKey(set)]); y {
+			expanded[set[0].Header().Name] = labels
+		}
+	}
+	if denial && result == secSecure {
+		result = provesDenial(resp.Ns, target, resp.Question[0].Qtype, resp.Rcode == dns.RcodeNameError)
+	}
+	if len(expanded) > 0 && result == secSecure {
+		var proofs = resp.Ns
+		if !denial { // not validated yet
+			proofs = v.verifiedProofs(entry, resp.Ns)
+		}
+		for name, labels := range expanded {
+			if !provesWildcard(proofs, name, labels) {
+				return secBogus
+			}
+		}
+	}
+	return result
+}
+
+// The rrset is verified with the keys of the signer zone, or unsigned
+// under an insecure delegation.
+func (v *validator) validateRRset(entry *entry, set []dns.RR, rrsigs []*dns.RRSIG) secState {
+	name := set[0].Header().Name
+	if len(rrsigs) == 0 {
+		state, _ := v.closestZone(entry, name)
+		if state == secSecure {
+			return secBogus
+		}
+		return state
+	}
+	signer := strings.ToLower(rrsigs[0].SignerName)
+	if !dns.IsSubDomain(signer, strings.ToLower(name)) {
+		return secBogus
+	}
+	state, keys := v.closestZone(entry, signer)
+	if state == secSecure && !verifyRRset(set, rrsigs, keys) {
+		return secBogus
+	}
+	return state
+}
+
+// The NSEC/NSEC3 of authority verified, the others are ignored.
+func (v *validator) verifiedProofs(entry *entry, ns []dns.RR) []dns.RR {
+	sets, sigs := groupRRsets(ns)
+	var proofs []dns.RR
+	for _, set := range sets {
+		switch set[0].Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			rrsigs := sigs[rrsetKey(set)]
+			if len(rrsigs) > 0 && v.validateRRset(entry, set, rrsigs) == secSecure {
+				proofs = append(proofs, set...)
+			}
+		}
+	}
+	return proofs
+}
+
+// Whether the rrset is expanded from a wildcard, the labels of RRSIG are
+// fewer than the owner (RFC 4035 5.3.4). Any of the signatures counts.
+func wildcardLabels(name string, rrsigs []*dns.RRSIG) (int, bool) {
+	count := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		count-- // the wildcard owner itself
+	}
+	var labels = count
+	for _, sig := range rrsigs {
+		if int(sig.Labels) < labels {
+			labels = int(sig.Labels)
+		}
+	}
+	return labels, labels < count
+}
+
+// The expanded answer requires the proof that name doesn't exist, the NSEC
+// covering it, or the NSEC3 covering the next closer name of the closest
+// encloser of labels (RFC 5155 8.8).
+func provesWildcard(proofs []dns.RR, name string, labels int) bool {
+	ls := dns.SplitDomainName(name)
+	nc := dns.Fqdn(strings.Join(ls[len(ls)-labels-1:], "."))
+	for _, rr := range proofs {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(r, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nsec3Covers(r, nc) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The target of the CNAME chain in answer, and whether the response
+// denies the records of qtype there.
+func denialTarget(resp *dns.Msg) (string, bool) {
+	q := resp.Question[0]
+	name := q.Name
+	var found bool
+	for i := 0; i < 8; i++ {
+		var next string
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == q.Qtype {
+				found = true
+			} else if c, y := rr.(*dns.CNAME); y && q.Qtype != dns.TypeCNAME {
+				next = c.Target
+			}
+		}
+		if found || next == "" {
+			break
+		}
+		name = next
+	}
+	return name, resp.Rcode == dns.RcodeNameError || !found
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the bitmap denies qtype. The DS is denied by the parent side of
+// delegation only, and the others by the child side.
+func provesNodata(bitmap []uint16, qtype uint16) bool {
+	if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	delegation := hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+	if qtype == dns.TypeDS {
+		return !hasType(bitmap, dns.TypeSOA)
+	}
+	return !delegation
+}
+
+// Canonical order of names (RFC 4034 6.1), by the labels from the right.
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// Whether name is between the owner and next name of NSEC, exclusively.
+func nsecCovers(r *dns.NSEC, name string) bool {
+	owner, next := r.Hdr.Name, r.NextDomain
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+	// the last NSEC of zone wraps to the apex
+	return canonicalLess(owner, name) || canonicalLess(name, next)
+}
+
+// The wildcard at the closest encloser of name, which is the longest
+// ancestor shared with the owner or next name of the covering NSEC.
+func nsecWildcard(r *dns.NSEC, name string) string {
+	n := dns.CompareDomainName(name, r.Hdr.Name)
+	if m := dns.CompareDomainName(name, r.NextDomain); m > n {
+		n = m
+	}
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn("*." + strings.Join(labels[len(labels)-n:], "."))
+}
+
+// The denial of name/qtype by NSEC (RFC 4035 5.4), or the wildcard
+// NODATA at the closest encloser.
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) secState {
+	var nodata = func(r *dns.NSEC) bool { return provesNodata(r.TypeBitMap, qtype) }
+	var cover *dns.NSEC
+	for _, r := range nsecs {
+		if strings.EqualFold(r.Hdr.Name, name) {
+			if !nxdomain && nodata(r) {
+				return secSecure
+			}
+			return secBogus
+		}
+		if nsecCovers(r, name) {
+			cover = r
+		}
+	}
+	if cover == nil {
+		return secBogus
+	}
+	wildcard := nsecWildcard(cover, name)
+	for _, r := range nsecs {
+		switch {
+		case nxdomain && nsecCovers(r, wildcard):
+			return secSecure
+		case !nxdomain && strings.EqualFold(r.Hdr.Name, wildcard) && nodata(r):
+			return secSecure
+		}
+	}
+	return secBogus
+}
+
+// The miekg Cover includes the owner itself.
+func nsec3Covers(r *dns.NSEC3, name string) bool {
+	return r.Cover(name) && !r.Match(name)
+}
+
+// The closest encloser proof of NSEC3 (RFC 5155 8.3), the closest encloser
+// is matched and the next closer name is covered.
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (ce string, cover *dns.NSEC3) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		ce = dns.Fqdn(strings.Join(labels[i:], "."))
+		nc := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		var matched bool
+		for _, r := range nsec3s {
+			matched = matched || r.Match(ce)
+		}
+		if !matched {
+			continue
+		}
+		for _, r := range nsec3s {
+			if nsec3Covers(r, nc) {
+				return ce, r
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// The denial of name/qtype by NSEC3 (RFC 5155 8.4-8.7), the opt-out span
+// proves the DS absence insecure only.
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) secState {
+	var nodata = func(r *dns.NSEC3) bool { return provesNodata(r.TypeBitMap, qtype) }
+	if !nxdomain {
+		for _, r := range nsec3s {
+			if r.Match(name) {
+				if nodata(r) {
+					return secSecure
+				}
+				return secBogus
+			}
+		}
+	}
+	ce, cover := closestEncloser(nsec3s, name)
+	if cover == nil {
+		return secBogus
+	}
+	if !nxdomain && qtype == dns.TypeDS && cover.Flags&1 == 1 {
+		return secInsecure
+	}
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, r := range nsec3s {
+		switch {
+		case nxdomain && nsec3Covers(r, wildcard):
+			return secSecure
+		case !nxdomain && r.Match(wildcard) && nodata(r):
+			return secSecure
+		}
+	}
+	return secBogus
+}
+
+// Whether the validated NSEC/NSEC3 of authority prove the denial.
+func provesDenial(ns []dns.RR, name string, qtype uint16, nxdomain bool) secState {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range ns {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, r)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, r)
+		}
+	}
+	switch {
+	case nsecs != nil:
+		return nsecDenial(nsecs, name, qtype, nxdomain)
+	case nsec3s != nil:
+		return nsec3Denial(nsec3s, name, qtype, nxdomain)
+	}
+	return secBogus
+}
+
+// Validate the response of upstream, then apply filters with the result.
+func (v *validator) check(entry *entry, req, resp *dns.Msg) *dns.Msg {
+	state := v.validate(entry, resp)
+	q := req.Question[0]
+	log.Printf("\tdnssec [%s %s] %s", q.Name, dns.TypeToString[q.Qtype], state)
+	switch state {
+	case secBogus:
+		var fail = new(dns.Msg)
+		fail.SetRcode(req, dns.RcodeServerFailure)
+		return fail
+	case secSecure:
+		resp.AuthenticatedData = true
+	default:
+		resp.AuthenticatedData = false
+	}
+	if len(resp.Answer) > 0 {
+		resp = applyFilters(resp, entry.filters, state)
+	}
+	return resp
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone signs the records with a single key of both KSK and ZSK.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+// The rrset followed by its signature
+func (z *testZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: 3600},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]dns.RR{}, rrset...), sig)
+}
+
+func (z *testZone) soa() dns.RR {
+	host := strings.TrimPrefix(z.name, ".")
+	return newTestRR("%s 3600 IN SOA ns.%s host.%s 1 7200 3600 86400 3600", z.name, host, host)
+}
+
+func newTestRR(format string, args ...interface{}) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf(format, args...))
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func testNSEC(owner, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// The NSEC3 chain of the names in zone, without salt and iterations.
+func testNSEC3Chain(zone string, names map[string][]uint16) []*dns.NSEC3 {
+	var hashes []string
+	var types = make(map[string][]uint16)
+	for name, ts := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, h)
+		types[h] = ts
+	}
+	sort.Strings(hashes)
+	var chain []*dns.NSEC3
+	for i, h := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+			Hash:       dns.SHA1,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			HashLength: 20,
+			TypeBitMap: types[h],
+		})
+	}
+	return chain
+}
+
+// fakeUpstream answers the DS/DNSKEY lookups of validator.
+type fakeUpstream map[string]*dns.Msg
+
+func (f fakeUpstream) set(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	var m = new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	f[fmt.Sprint(name, qtype)] = m
+}
+
+func (f fakeUpstream) exchange(e *entry, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if m := f[fmt.Sprint(strings.ToLower(q.Name), q.Qtype)]; m != nil {
+		m = m.Copy()
+		m.Id = req.Id
+		return m
+	}
+	return nil
+}
+
+func newTestMsg(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	var m = new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	return m
+}
+
+// The signed wildcard rrset as the answer of name.
+func expandWildcard(signed []dns.RR, name string) []dns.RR {
+	var arr []dns.RR
+	for _, rr := range signed {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		arr = append(arr, rr)
+	}
+	return arr
+}
+
+func concat(sets ...[]dns.RR) []dns.RR {
+	var arr []dns.RR
+	for _, s := range sets {
+		arr = append(arr, s...)
+	}
+	return arr
+}
+
+func TestValidate(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	example3 := newTestZone(t, "example3.")
+
+	var up = make(fakeUpstream)
+	up.set(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil)
+	up.set("example.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, example.ds()), nil)
+	up.set("example3.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, example3.ds()), nil)
+	up.set("insecure.", dns.TypeDS, dns.RcodeSuccess, nil, concat(
+		root.sign(t, root.soa()),
+		root.sign(t, testNSEC("insecure.", "zzz.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)),
+	))
+	up.set("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.sign(t, example.key), nil)
+	up.set("example3.", dns.TypeDNSKEY, dns.RcodeSuccess, example3.sign(t, example3.key), nil)
+
+	// example. -> www.example. -> example.
+	apexNSEC := example.sign(t, testNSEC("example.", "www.example.",
+		dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY))
+	wwwNSEC := example.sign(t, testNSEC("www.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	up.set("www.example.", dns.TypeDS, dns.RcodeSuccess, nil, concat(example.sign(t, example.soa()), wwwNSEC))
+
+	var chain3 []dns.RR
+	for _, r := range testNSEC3Chain("example3.", map[string][]uint16{
+		"example3.":     {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"www.example3.": {dns.TypeA, dns.TypeRRSIG},
+	}) {
+		chain3 = append(chain3, example3.sign(t, r)...)
+	}
+
+	// the wildcard of example., and the one of example3. in its own chain
+	wildNSEC := example.sign(t, testNSEC("*.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	wildA := example.sign(t, newTestRR("*.example. 3600 IN A 192.0.2.9"))
+	wildA3 := example3.sign(t, newTestRR("*.example3. 3600 IN A 192.0.2.9"))
+	var wildChain3 []dns.RR
+	for _, r := range testNSEC3Chain("example3.", map[string][]uint16{
+		"example3.":     {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"*.example3.":   {dns.TypeA, dns.TypeRRSIG},
+		"www.example3.": {dns.TypeA, dns.TypeRRSIG},
+	}) {
+		wildChain3 = append(wildChain3, example3.sign(t, r)...)
+	}
+
+	wwwA := example.sign(t, newTestRR("www.example. 3600 IN A 192.0.2.1"))
+	forgedA := append([]dns.RR{newTestRR("www.example. 3600 IN A 198.51.100.1")}, wwwA[1])
+
+	var tests = []struct {
+		name string
+		resp *dns.Msg
+		want secState
+	}{
+		{"secure answer", newTestMsg("www.example.", dns.TypeA, dns.RcodeSuccess, wwwA, nil), secSecure},
+		{"forged answer", newTestMsg("www.example.", dns.TypeA, dns.RcodeSuccess, forgedA, nil), secBogus},
+		{"unsigned answer of secure zone", newTestMsg("www.example.", dns.TypeA, dns.RcodeSuccess,
+			wwwA[:1], nil), secBogus},
+		{"insecure delegation", newTestMsg("host.insecure.", dns.TypeA, dns.RcodeSuccess,
+			[]dns.RR{newTestRR("host.insecure. 300 IN A 192.0.2.2")}, nil), secInsecure},
+		{"nxdomain by nsec", newTestMsg("nope.example.", dns.TypeA, dns.RcodeNameError, nil,
+			concat(example.sign(t, example.soa()), apexNSEC)), secSecure},
+		{"nxdomain by replayed nsec", newTestMsg("abc.example.", dns.TypeA, dns.RcodeNameError, nil,
+			concat(example.sign(t, example.soa()), wwwNSEC)), secBogus},
+		{"nxdomain of existing name", newTestMsg("www.example.", dns.TypeA, dns.RcodeNameError, nil,
+			concat(example.sign(t, example.soa()), wwwNSEC, apexNSEC)), secBogus},
+		{"nodata by nsec", newTestMsg("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+			concat(example.sign(t, example.soa()), wwwNSEC)), secSecure},
+		{"nodata of existing type", newTestMsg("www.example.", dns.TypeA, dns.RcodeSuccess, nil,
+			concat(example.sign(t, example.soa()), wwwNSEC)), secBogus},
+		{"nodata without proof", newTestMsg("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+			example.sign(t, example.soa())), secBogus},
+		{"nxdomain by nsec3", newTestMsg("nope.example3.", dns.TypeA, dns.RcodeNameError, nil,
+			concat(example3.sign(t, example3.soa()), chain3)), secSecure},
+		{"nxdomain of existing name by nsec3", newTestMsg("www.example3.", dns.TypeA, dns.RcodeNameError, nil,
+			concat(example3.sign(t, example3.soa()), chain3)), secBogus},
+		{"nodata by nsec3", newTestMsg("www.example3.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+			concat(example3.sign(t, example3.soa()), chain3)), secSecure},
+		{"nodata of existing type by nsec3", newTestMsg("www.example3.", dns.TypeA, dns.RcodeSuccess, nil,
+			concat(example3.sign(t, example3.soa()), chain3)), secBogus},
+		{"wildcard owner", newTestMsg("*.example.", dns.TypeA, dns.RcodeSuccess, wildA, nil), secSecure},
+		{"wildcard expanded by nsec", newTestMsg("foo.example.", dns.TypeA, dns.RcodeSuccess,
+			expandWildcard(wildA, "foo.example."), wildNSEC), secSecure},
+		{"wildcard expanded without proof", newTestMsg("foo.example.", dns.TypeA, dns.RcodeSuccess,
+			expandWildcard(wildA, "foo.example."), nil), secBogus},
+		{"wildcard expanded by replayed nsec", newTestMsg("foo.example.", dns.TypeA, dns.RcodeSuccess,
+			expandWildcard(wildA, "foo.example."), wwwNSEC), secBogus},
+		{"wildcard expanded by unsigned nsec", newTestMsg("foo.example.", dns.TypeA, dns.RcodeSuccess,
+			expandWildcard(wildA, "foo.example."), wildNSEC[:1]), secBogus},
+		{"wildcard expanded by nsec3", newTestMsg("a.b.example3.", dns.TypeA, dns.RcodeSuccess,
+			expandWildcard(wildA3, "a.b.example3."), wildChain3), secSecure},
+		{"wildcard expanded over existing name by nsec3", newTestMsg("www.example3.", dns.TypeA, dns.RcodeSuccess,
+			expandWildcard(wildA3, "www.example3."), wildChain3), secBogus},
+	}
+	for _, tt := range tests {
+		v, err := newValidator(nil, []string{root.ds().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.exchange = up.exchange
+		if got := v.validate(new(entry), tt.resp); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The unsigned NSEC without DS must not downgrade the signed zone.
+func TestValidateForgedInsecureDelegation(t *testing.T) {
+	root := newTestZone(t, ".")
+	var up = make(fakeUpstream)
+	up.set(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil)
+	up.set("example.", dns.TypeDS, dns.RcodeSuccess, nil, []dns.RR{
+		testNSEC("example.", "zzz.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC),
+	})
+
+	v, err := newValidator(nil, []string{root.ds().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.exchange = up.exchange
+	resp := newTestMsg("www.example.", dns.TypeA, dns.RcodeSuccess,
+		[]dns.RR{newTestRR("www.example. 3600 IN A 198.51.100.1")}, nil)
+	if got := v.validate(new(entry), resp); got != secBogus {
+		t.Errorf("got %s, want bogus", got)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	learnStrikes = 2              // the mismatches before learning the address
+	learnTTL     = 24 * time.Hour // of the learned addresses
+)
+
+// verifier re-queries the dubious answers over the verify backends, or the
+// tcp of udp backends. Only the verify backends are trusted, the address
+// they disagree with repeatedly is learned into the runtime drop list.
+type verifier struct {
+	backends  []*backend // trusted, or the tcp of udp backends if nil
+	learnFile string
+	learned   *learnedFilter
+	mu        sync.Mutex
+	pending   map[string]bool
+	strikes   map[string]int // of the addresses not learned yet
+}
+
+// learnedFilter drops the answers containing the learned addresses,
+// it could be updated at runtime. The lines of learn_file are "ADDR EXPIRY",
+// or the permanent "CIDR" added by hand.
+type learnedFilter struct {
+	mu      sync.RWMutex
+	rules   *cidrTree            // permanent
+	learned map[string]time.Time // address to expiry
+}
+
+func newLearnedFilter() *learnedFilter {
+	return &learnedFilter{rules: newCidrTree(), learned: make(map[string]time.Time)}
+}
+
+func (f *learnedFilter) filter(answers []dns.RR, ctx *filterContext) []dns.RR {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	now := time.Now()
+	for _, rr := range answers {
+		// the learned are of A only
+		var exp time.Time
+		if a, y := rr.(*dns.A); y {
+			exp = f.learned[a.A.String()]
+		}
+		if now.Before(exp) || f.rules.containsAnswer(rr) {
+			log.Println("\tdrop learned", rr)
+			return nil
+		}
+	}
+	return answers
+}
+
+func (f *learnedFilter) add(ip net.IP, expiry time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if exp, y := f.learned[ip.String()]; y && time.Now().Before(exp) || f.rules.contains(ip) {
+		return false
+	}
+	f.learned[ip.String()] = expiry
+	return true
+}
+
+func (f *learnedFilter) load(file string) {
+	now := time.Now()
+	addItemsFromFile(file, func(line string) {
+		fields := strings.Fields(line)
+		ipnet, err := parseCIDR(fields[0])
+		if err != nil {
+			panic("bad cidr " + fields[0])
+		}
+		if len(fields) == 1 {
+			f.rules.insert(ipnet, true)
+			return
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			panic("bad expiry " + fields[1])
+		}
+		if exp := time.Unix(sec, 0); now.Before(exp) {
+			f.learned[ipnet.IP.String()] = exp
+		}
+	})
+}
+
+// Copy the addresses learned at runtime.
+func (f *learnedFilter) merge(old *learnedFilter) {
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for k, exp := range old.learned {
+		if now.Before(exp) {
+			f.learned[k] = exp
+		}
+	}
+}
+
+// Keep the learned addresses on reload if they are not persisted.
+func (c *config) inheritLearned(old *config) {
+	if c.verifier == nil || old.verifier == nil || c.verifier.learnFile != "" {
+		return
+	}
+	c.verifier.learned.merge(old.verifier.learned)
+}
+
+func (c *config) parseVerify(ck *configChecker, d *verify_descr) *verifier {
+	var v = &verifier{
+		learnFile: d.LearnFile,
+		learned:   newLearnedFilter(),
+		pending:   make(map[string]bool),
+		strikes:   make(map[string]int),
+	}
+	for i, str := range d.Backends {
+		bs := c.allBackends[str]
+		if bs == nil {
+			ck.errorf([]interface{}{"verify", "backends", i}, "unknown backend %q", str)
+		}
+		v.backends = append(v.backends, bs...)
+	}
+	if v.learnFile != "" {
+		if _, err := os.Stat(v.learnFile); err == nil {
+			ck.try(func() { v.learned.load(v.learnFile) }, "verify", "learn_file")
+		}
+	}
+	return v
+}
+
+// The single A answer marked by droppingFilter
+func isDubious(msg *dns.Msg) bool {
+	if len(msg.Answer) != 1 {
+		return false
+	}
+	a, y := msg.Answer[0].(*dns.A)
+	return y && a.Hdr.Ttl == 2
+}
+
+func backendHost(be *backend) string {
+	if host, _, err := net.SplitHostPort(be.addr); err == nil {
+		return host
+	}
+	return be.addr
+}
+
+// The verify backends other than the servers of entry, the same server
+// queried again is not a second opinion.
+func (v *verifier) trustedBackends(entry *entry) []*backend {
+	var hosts = make(map[string]bool)
+	for _, be := range entry.backends {
+		hosts[backendHost(be)] = true
+	}
+	var bs []*backend
+	for _, be := range v.backends {
+		if !hosts[backendHost(be)] {
+			bs = append(bs, be)
+		}
+	}
+	return bs
+}
+
+func tcpBackends(entry *entry) []*backend {
+	var bs []*backend
+	for _, be := range entry.backends {
+		if be.tcp != nil {
+			bs = append(bs, be.tcp)
+		} else {
+			bs = append(bs, be)
+		}
+	}
+	return bs
+}
+
+// Query again then replace the cache if the answer differs.
+func (v *verifier) verify(conf *config, e *entry, req, dubious *dns.Msg, key string, subnet *dns.EDNS0_SUBNET) {
+	v.mu.Lock()
+	if v.pending[key] {
+		v.mu.Unlock()
+		return
+	}
+	v.pending[key] = true
+	v.mu.Unlock()
+	defer func() {
+		v.mu.Lock()
+		delete(v.pending, key)
+		v.mu.Unlock()
+	}()
+
+	var nextReq = req.Copy()
+	nextReq.Id = dns.Id()
+	// not filtered, the answer might be same as the dubious
+	var trusted = v.trustedBackends(e)
+	var ventry = &entry{backends: trusted}
+	if trusted == nil {
+		ventry.backends = tcpBackends(e)
+	}
+	msg := queryGroup(conf, ventry.backends, ventry, nextReq, false)
+	if msg == nil || msg.Rcode != dns.RcodeSuccess {
+		log.Printf("\tverify %s failed", key)
+		return
+	}
+
+	var forged = dubious.Answer[0].(*dns.A)
+	for _, rr := range msg.Answer {
+		if a, y := rr.(*dns.A); y && a.A.Equal(forged.A) {
+			log.Printf("\tverify %s %s passed", key, forged.A)
+			v.mu.Lock()
+			delete(v.strikes, forged.A.String())
+			v.mu.Unlock()
+			return
+		}
+	}
+	log.Printf("\tverify %s %s forged, the answer is %s", key, forged.A, msg.Answer)
+	if trusted != nil {
+		v.strike(forged.A)
+	}
+	if len(msg.Answer) > 0 {
+		msg = applyFilters(msg, e.filters, secIndeterminate)
+	}
+	if msg != nil && len(msg.Answer) > 0 {
+		rrc.set(key, subnet, msg, 0)
+	}
+}
+
+// Learn the address reported forged learnStrikes times.
+func (v *verifier) strike(ip net.IP) {
+	var k = ip.String()
+	v.mu.Lock()
+	v.strikes[k]++
+	n := v.strikes[k]
+	if n >= learnStrikes {
+		delete(v.strikes, k)
+	}
+	v.mu.Unlock()
+	if n < learnStrikes {
+		return
+	}
+	expiry := time.Now().Add(learnTTL)
+	if v.learned.add(ip, expiry) {
+		log.Printf("\tlearned %s until %s", ip, expiry.Format(time.RFC3339))
+		v.persist(ip, expiry)
+	}
+}
+
+func (v *verifier) persist(ip net.IP, expiry time.Time) {
+	if v.learnFile == "" {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f, err := os.OpenFile(v.learnFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("learn", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, ip, expiry.Unix())
+}
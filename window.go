@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The injected answer always arrives first, so the replies within the window
+// are collected and scored, then the best one is accepted.
+type candidate struct {
+	msg    *dns.Msg
+	rtt    int
+	be     *backend
+	score  int
+	reason []string
+}
+
+const (
+	scoreDirty    = -100 // hit the blacklist, or not an answer of the question
+	scoreNoEdns   = -20  // without OPT, but the request had
+	scoreDubious  = -10  // only one A without any other section
+	scoreBadTTL   = -5   // TTL of zero or over a week
+	scoreLaterWin = 1    // per the order of arrival
+)
+
+// Collect the reply if the window is open, returns false if the decision
+// has been made.
+func (t *transaction) collect(msg *dns.Msg, rtt int, be *backend) bool {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.released {
+		return false
+	}
+	var q = t.req.Question[0]
+	log.Printf("Query [%s %s] @%s rtt=%d answers=%d collected", q.Name, dns.TypeToString[q.Qtype], be.url, rtt, len(msg.Answer))
+	t.candidates = append(t.candidates, &candidate{msg: msg, rtt: rtt, be: be})
+	if len(t.candidates) == 1 {
+		time.AfterFunc(t.window, t.release)
+	}
+	return true
+}
+
+func (t *transaction) score(c *candidate, order int) {
+	var add = func(score int, reason string) {
+		c.score += score
+		c.reason = append(c.reason, reason)
+	}
+	var q = t.req.Question[0]
+	var m = c.msg
+	if len(m.Question) != 1 || m.Question[0].Qtype != q.Qtype || !strings.EqualFold(m.Question[0].Name, q.Name) {
+		add(scoreDirty, "question")
+	}
+	if !t.checked && len(m.Answer) > 0 {
+		// dry run on the copy, filters may modify the records
+		if applyFilters(m.Copy(), t.filters, secIndeterminate) == nil {
+			add(scoreDirty, "blacklist")
+		}
+	}
+	if t.req.IsEdns0() != nil && m.IsEdns0() == nil {
+		add(scoreNoEdns, "no-edns")
+	}
+	if len(m.Answer) == 1 && len(m.Ns) == 0 && len(m.Extra) == 0 {
+		if _, y := m.Answer[0].(*dns.A); y {
+			add(scoreDubious, "single-a")
+		}
+	}
+	for _, rr := range m.Answer {
+		if ttl := rr.Header().Ttl; ttl == 0 || ttl > 7*86400 {
+			add(scoreBadTTL, "ttl")
+			break
+		}
+	}
+	c.score += order * scoreLaterWin
+}
+
+// Choose the best of candidates when the window closed
+func (t *transaction) release() {
+	t.wmu.Lock()
+	t.released = true
+	var best *candidate
+	var report []string
+	for i, c := range t.candidates {
+		t.score(c, i)
+		report = append(report, fmt.Sprintf("#%d@%s=%d%v", i, c.be.url, c.score, c.reason))
+		if best == nil || c.score >= best.score {
+			best = c
+		}
+	}
+	t.wmu.Unlock()
+
+	var q = t.req.Question[0]
+	var msg = best.msg
+	if best.score <= scoreDirty/2 {
+		log.Printf("\twindow [%s %s] all dirty %s", q.Name, dns.TypeToString[q.Qtype], strings.Join(report, " "))
+		msg = nil
+	} else {
+		log.Printf("\twindow [%s %s] accept %s", q.Name, dns.TypeToString[q.Qtype], strings.Join(report, " "))
+		t.lastMsg = msg
+		if len(msg.Answer) > 0 && !t.checked {
+			msg = applyFilters(msg, t.filters, secIndeterminate)
+		}
+	}
+	select {
+	case t.result <- msg:
+	default:
+	}
+}